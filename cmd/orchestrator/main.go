@@ -1,7 +1,17 @@
 package main
 
-import "github.com/hidnt/lms_yandex_final/internal/orchestrator"
+import (
+	"os"
+
+	"github.com/hidnt/lms_yandex_final/internal/orchestrator"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(orchestrator.RunMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "quota" {
+		os.Exit(orchestrator.RunQuota(os.Args[2:]))
+	}
 	orchestrator.StartOrchestrator()
 }
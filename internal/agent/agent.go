@@ -13,6 +13,7 @@ import (
 	"github.com/joho/godotenv"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
 func StartAgents() {
@@ -29,8 +30,16 @@ func StartAgents() {
 		computing_power = 1
 	}
 
-	for range computing_power {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+
+	for i := range computing_power {
 		go func() {
+			name := fmt.Sprintf("%s-%d", hostname, i+1)
+			ctx := metadata.AppendToOutgoingContext(context.TODO(), "agent", name)
+
 			addr := fmt.Sprintf("localhost:%s", port)
 			conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 			if err != nil {
@@ -42,7 +51,7 @@ func StartAgents() {
 			grpcClient := pb.NewOrchestratorClient(conn)
 
 			for {
-				task, err := grpcClient.GetTask(context.TODO(), &pb.Empty{})
+				task, err := grpcClient.GetTask(ctx, &pb.Empty{})
 				if err != nil {
 					time.Sleep(time.Second)
 					continue
@@ -76,7 +85,7 @@ func StartAgents() {
 					resp.Error = true
 				}
 
-				grpcClient.SetResult(context.TODO(), &resp)
+				grpcClient.SetResult(ctx, &resp)
 			}
 		}()
 	}
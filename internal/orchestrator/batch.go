@@ -0,0 +1,155 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+type ResponseBatchItem struct {
+	ID     int64      `json:"id,omitempty"`
+	Status string     `json:"status,omitempty"`
+	Result float64    `json:"result,omitempty"`
+	RunAt  *time.Time `json:"runAt,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	Code   string     `json:"code,omitempty"`
+}
+
+type BatchHandler struct {
+	db        calcStore
+	scheduler *Scheduler
+	quotas    *Quotas
+	promoter  *Promoter
+	cache     *ResultCache
+	webhooks  *Webhooks
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request []RequestCalc
+	defer r.Body.Close()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	// Длина и число токенов проверяются до обращения к базе: функции пользователя
+	// загружаются, только если хотя бы одно выражение прошло эту проверку
+	items := make([]ResponseBatchItem, len(request))
+	passed := 0
+	for i, req := range request {
+		if err := calculation.CheckInput(req.Expression); err != nil {
+			items[i].Error = err.Error()
+			items[i].Code = limitCode(err)
+			continue
+		}
+		passed++
+	}
+	var funcs []database.Function
+	if passed > 0 {
+		var err error
+		funcs, err = h.db.SelectFunctions(context.TODO(), userID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Каждое выражение проверяется отдельно. Некорректные выражения сохраняются со
+	// статусом-ошибкой, как в /calculate; не сохраняются только не прошедшие лимиты
+	// и с неверными priority, run_at, delay или callback_url.
+	var exprs []database.Expression
+	var positions []int
+	now := time.Now()
+	for i, req := range request {
+		if items[i].Code != "" {
+			continue
+		}
+		if err := validatePriority(req.Priority); err != nil {
+			items[i].Error = err.Error()
+			continue
+		}
+		if err := h.webhooks.validateCallback(r.Context(), req.CallbackURL); err != nil {
+			items[i].Error = err.Error()
+			continue
+		}
+		expr, err := buildExpression(req.Expression, funcs)
+		if code := limitCode(err); code != "" {
+			items[i].Error = err.Error()
+			items[i].Code = code
+			continue
+		}
+		expr.Priority = req.Priority
+		expr.CallbackURL = req.CallbackURL
+		if err != nil {
+			expr.Status = err.Error()
+			expr.CompletedAt = &now
+			items[i].Error = err.Error()
+		} else {
+			at, err := runAt(req, now)
+			if err != nil {
+				items[i].Error = err.Error()
+				continue
+			}
+			expr = h.cache.Apply(userID, expr, now)
+			if at != nil && len(expr.Actions) > 0 {
+				expr.Status = "scheduled"
+				expr.RunAt = at
+			}
+		}
+		exprs = append(exprs, expr)
+		positions = append(positions, i)
+	}
+
+	// Лимиты проверяются для пачки целиком: она либо сохраняется, либо нет
+	var actions []int
+	for j, expr := range exprs {
+		if items[positions[j]].Error == "" {
+			actions = append(actions, len(expr.Actions))
+		}
+	}
+	var ids []int64
+	if len(exprs) > 0 {
+		err := h.quotas.Submit(context.TODO(), userID, actions, func() (err error) {
+			ids, err = h.db.InsertExpressions(context.TODO(), userID, exprs)
+			return err
+		})
+		if err != nil {
+			writeLimitError(w, err)
+			return
+		}
+	}
+
+	accepted := 0
+	for j, id := range ids {
+		items[positions[j]].ID = id
+		if items[positions[j]].Error != "" {
+			items[positions[j]].Status = exprs[j].Status
+			continue
+		}
+		accepted++
+		if exprs[j].RunAt == nil {
+			h.scheduler.Add(userID, id, exprs[j])
+		} else {
+			h.promoter.Wake()
+		}
+		items[positions[j]].RunAt = exprs[j].RunAt
+		if len(exprs[j].Actions) == 0 {
+			items[positions[j]].Status = exprs[j].Status
+			items[positions[j]].Result = exprs[j].Result
+			h.webhooks.Enqueue(context.TODO(), userID, id)
+		}
+	}
+
+	if accepted == 0 && len(request) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(items)
+}
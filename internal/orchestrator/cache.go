@@ -0,0 +1,240 @@
+package orchestrator
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const defaultCacheTTL = time.Hour
+
+// cacheAgent - имя вычислителя в событиях о действиях, результат которых взят из кэша
+const cacheAgent = "cache"
+
+type cacheEntry struct {
+	key     calculation.Key
+	value   float64
+	expires time.Time
+}
+
+// CacheStats - настройки кэша результатов и попадания и промахи одного пользователя.
+// Сколько записей в общем кэше, не сообщается: это зависит от запросов других пользователей.
+type CacheStats struct {
+	Enabled    bool   `json:"enabled"`
+	MaxEntries int    `json:"maxEntries"`
+	TTL        string `json:"ttl,omitempty"`
+	Hits       int64  `json:"hits"`
+	Misses     int64  `json:"misses"`
+}
+
+type cacheCounters struct {
+	hits   int64
+	misses int64
+}
+
+// ResultCache хранит результаты выражений и их поддеревьев по каноническому ключу
+// (calculation.Key) общими для всех пользователей: результат арифметики от автора не
+// зависит. Хранится не больше size записей, давно не использованные вытесняются,
+// записи старше ttl не выдаются. Ошибки вычисления не кэшируются. Попадания и промахи
+// считаются отдельно для каждого пользователя.
+type ResultCache struct {
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	entries  map[calculation.Key]*list.Element
+	lru      *list.List // в начале - недавно использованные
+	counters map[int64]*cacheCounters
+}
+
+// NewResultCache возвращает nil, если size не больше 0: кэш выключен
+func NewResultCache(size int, ttl time.Duration) *ResultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &ResultCache{size: size, ttl: ttl, entries: make(map[calculation.Key]*list.Element), lru: list.New(), counters: make(map[int64]*cacheCounters)}
+}
+
+// resultCacheFromEnv создаёт кэш размером RESULT_CACHE_SIZE записей со временем жизни
+// RESULT_CACHE_TTL (по умолчанию час, 0 - без ограничения)
+func resultCacheFromEnv() *ResultCache {
+	ttl := defaultCacheTTL
+	if s := os.Getenv("RESULT_CACHE_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			ttl = d
+		}
+	}
+	return NewResultCache(envLimit("RESULT_CACHE_SIZE"), ttl)
+}
+
+// Get возвращает результат поддерева с ключом key и учитывает попадание или промах пользователя userID
+func (c *ResultCache) Get(userID int64, key calculation.Key, now time.Time) (float64, bool) {
+	values, ok := c.lookup(userID, now, key)
+	if !ok {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// lookup возвращает результаты всех ключей сразу и считается одним попаданием или промахом
+func (c *ResultCache) lookup(userID int64, now time.Time, keys ...calculation.Key) ([]float64, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counters, ok := c.counters[userID]
+	if !ok {
+		counters = &cacheCounters{}
+		c.counters[userID] = counters
+	}
+	values := make([]float64, len(keys))
+	for i, key := range keys {
+		v, ok := c.get(key, now)
+		if !ok {
+			counters.misses++
+			return nil, false
+		}
+		values[i] = v
+	}
+	counters.hits++
+	return values, true
+}
+
+func (c *ResultCache) get(key calculation.Key, now time.Time) (float64, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.ttl > 0 && !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return 0, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// Put запоминает результат поддерева
+func (c *ResultCache) Put(key calculation.Key, value float64, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(key, value, now)
+}
+
+func (c *ResultCache) put(key calculation.Key, value float64, now time.Time) {
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.value, e.expires = value, now.Add(c.ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: now.Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// PutActions запоминает результаты посчитанных действий закончившегося выражения: и по
+// ключу поддерева, и по ключу действия с подставленными аргументами, который ищет GetTask
+func (c *ResultCache) PutActions(actions []database.Action, now time.Time) {
+	if c == nil || len(actions) == 0 {
+		return
+	}
+	keys := calculation.SubtreeKeys(actions)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, a := range actions {
+		if !a.Completed {
+			continue
+		}
+		c.put(keys[i], a.Result, now)
+		if a.IdDepends[0] != -1 || a.IdDepends[1] != -1 {
+			arg1, arg2 := a.Arg1, a.Arg2
+			if d := a.IdDepends[0]; d != -1 {
+				arg1 = actions[d-1].Result
+			}
+			if d := a.IdDepends[1]; d != -1 {
+				arg2 = actions[d-1].Result
+			}
+			c.put(calculation.ActionKey(a.Operation, arg1, arg2), a.Result, now)
+		}
+	}
+}
+
+// Apply завершает выражение сразу, если в кэше есть его результат и значения всех
+// переменных скрипта. Иначе выражение возвращается без изменений.
+func (c *ResultCache) Apply(userID int64, expr database.Expression, now time.Time) database.Expression {
+	if c == nil || len(expr.Actions) == 0 {
+		return expr
+	}
+	keys := calculation.SubtreeKeys(expr.Actions)
+	need := []calculation.Key{keys[len(keys)-1]}
+	for _, v := range expr.Variables {
+		if v.ActionID != -1 {
+			need = append(need, keys[v.ActionID-1])
+		}
+	}
+	values, ok := c.lookup(userID, now, need...)
+	if !ok {
+		return expr
+	}
+
+	expr.Status, expr.Result, expr.CompletedAt, expr.Actions = "completed", values[0], &now, nil
+	variables := make([]database.Variable, 0, len(expr.Variables))
+	i := 1
+	for _, v := range expr.Variables {
+		if v.ActionID != -1 {
+			v.Value, v.ActionID = values[i], -1
+			i++
+		}
+		variables = append(variables, v)
+	}
+	expr.Variables = variables
+	return expr
+}
+
+// Stats возвращает настройки кэша и счётчики попаданий и промахов пользователя userID
+func (c *ResultCache) Stats(userID int64) CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := CacheStats{Enabled: true, MaxEntries: c.size}
+	if counters, ok := c.counters[userID]; ok {
+		stats.Hits, stats.Misses = counters.hits, counters.misses
+	}
+	if c.ttl > 0 {
+		stats.TTL = c.ttl.String()
+	}
+	return stats
+}
+
+type CacheHandler struct {
+	cache *ResultCache
+}
+
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.cache.Stats(userID))
+}
@@ -0,0 +1,131 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+type ActionNode struct {
+	database.Action
+	Status     string `json:"status"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+type ResponseActions struct {
+	ID      int64        `json:"id"`
+	Status  string       `json:"status"`
+	Actions []ActionNode `json:"actions"`
+}
+
+func (h *ExpressionsIdHandler) serveActions(w http.ResponseWriter, r *http.Request, expr database.Expression) {
+	actions, err := h.db.SelectActions(context.TODO(), userID, expr.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nodes := actionNodes(actions)
+
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(actionsDOT(expr, nodes)))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ResponseActions{ID: expr.ID, Status: expr.Status, Actions: nodes})
+}
+
+func actionNodes(actions []database.Action) []ActionNode {
+	nodes := make([]ActionNode, 0, len(actions))
+	for _, a := range actions {
+		node := ActionNode{Action: a, Status: actionStatus(a, actions)}
+		if a.StartedAt != nil && a.FinishedAt != nil {
+			node.DurationMs = a.FinishedAt.Sub(*a.StartedAt).Milliseconds()
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// computeMs - суммарное время, которое вычислители потратили на действия выражения
+func computeMs(actions []database.Action) int64 {
+	var total int64
+	for _, a := range actions {
+		if a.StartedAt != nil && a.FinishedAt != nil {
+			total += a.FinishedAt.Sub(*a.StartedAt).Milliseconds()
+		}
+	}
+	return total
+}
+
+func actionStatus(a database.Action, actions []database.Action) string {
+	if a.Completed {
+		return "completed"
+	}
+	if a.NowCalculate {
+		return "in progress"
+	}
+	for _, d := range a.IdDepends {
+		if d != -1 && !actions[d-1].Completed {
+			return "waiting"
+		}
+	}
+	return "ready"
+}
+
+var dotColors = map[string]string{
+	"completed":   "palegreen",
+	"in progress": "gold",
+	"ready":       "lightblue",
+	"waiting":     "lightgrey",
+}
+
+// actionsDOT строит граф действий выражения в формате Graphviz.
+func actionsDOT(expr database.Expression, nodes []ActionNode) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph expression_%d {\n", expr.ID)
+	fmt.Fprintf(&b, "\tlabel=%q;\n", fmt.Sprintf("expression %d: %s", expr.ID, expr.Status))
+	b.WriteString("\trankdir=BT;\n")
+	b.WriteString("\tnode [shape=box, style=filled];\n")
+
+	for _, n := range nodes {
+		arg1, arg2 := formatArg(n.Arg1, n.IdDepends[0]), formatArg(n.Arg2, n.IdDepends[1])
+		label := fmt.Sprintf("#%d: %s %s %s\n%s", n.ID, arg1, n.Operation, arg2, n.Status)
+		if n.Completed {
+			label += " = " + strconv.FormatFloat(n.Result, 'g', -1, 64)
+		}
+		if n.Agent != "" {
+			label += "\nagent: " + n.Agent
+		}
+		if n.DurationMs != 0 {
+			label += "\n" + (time.Duration(n.DurationMs) * time.Millisecond).String()
+		}
+		fmt.Fprintf(&b, "\ta%d [label=%q, fillcolor=%s];\n", n.ID, label, dotColors[n.Status])
+	}
+
+	for _, n := range nodes {
+		for _, d := range n.IdDepends {
+			if d != -1 {
+				fmt.Fprintf(&b, "\ta%d -> a%d;\n", d, n.ID)
+			}
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func formatArg(arg float64, depend int64) string {
+	if depend != -1 {
+		return fmt.Sprintf("#%d", depend)
+	}
+	return strconv.FormatFloat(arg, 'g', -1, 64)
+}
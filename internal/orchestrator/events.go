@@ -0,0 +1,178 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	EventActionClaimed       = "action_claimed"
+	EventActionCompleted     = "action_completed"
+	EventExpressionCompleted = "expression_completed"
+	EventExpressionFailed    = "expression_failed"
+	EventExpressionReleased  = "expression_released"
+)
+
+const (
+	subscriberBuffer = 64
+	pingInterval     = 15 * time.Second
+)
+
+type Event struct {
+	Type         string    `json:"type"`
+	UserID       int64     `json:"-"`
+	ExpressionID int64     `json:"expressionID"`
+	ActionID     int64     `json:"actionID,omitempty"`
+	Agent        string    `json:"agent,omitempty"`
+	Status       string    `json:"status,omitempty"`
+	Result       float64   `json:"result"`
+	Time         time.Time `json:"time"`
+}
+
+func (e Event) final() bool {
+	return e.Type == EventExpressionCompleted || e.Type == EventExpressionFailed
+}
+
+type subscriber struct {
+	filter func(Event) bool
+	ch     chan Event
+}
+
+// Hub раздаёт события о ходе вычислений подписчикам. GetTask и SetResult публикуют,
+// SSE-потоки подписываются. Медленный подписчик теряет события, но не тормозит вычислителей.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[*subscriber]struct{}{}}
+}
+
+func (h *Hub) Subscribe(filter func(Event) bool) (<-chan Event, func()) {
+	s := &subscriber{filter: filter, ch: make(chan Event, subscriberBuffer)}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+
+	return s.ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, s)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.filter(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+}
+
+type EventsHandler struct {
+	hub *Hub
+}
+
+// ServeHTTP отдаёт поток событий по всем выражениям пользователя
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := userID
+	events, cancel := h.hub.Subscribe(func(e Event) bool {
+		return e.UserID == user
+	})
+	defer cancel()
+
+	streamEvents(w, r, events, nil, false)
+}
+
+func (h *ExpressionsIdHandler) serveEvents(w http.ResponseWriter, r *http.Request, expr database.Expression) {
+	user := userID
+	events, cancel := h.hub.Subscribe(func(e Event) bool {
+		return e.UserID == user && e.ExpressionID == expr.ID
+	})
+	defer cancel()
+
+	// Выражение могло завершиться до подписки, тогда сразу отдаём итоговое событие
+	var last *Event
+	if e, err := firstExpression(h.db.SelectExpression(context.TODO(), user, expr.ID)); err == nil && isFinished(e.Status) {
+		last = &Event{Type: EventExpressionFailed, UserID: user, ExpressionID: e.ID, Status: e.Status, Result: e.Result, Time: time.Now()}
+		if e.Status == "completed" {
+			last.Type = EventExpressionCompleted
+		}
+	}
+
+	streamEvents(w, r, events, last, true)
+}
+
+// streamEvents пишет события в формате Server-Sent Events, пока клиент не отключится.
+// Если передано итоговое событие last, поток завершается сразу после него,
+// а с untilFinal - после первого события о завершении выражения.
+func streamEvents(w http.ResponseWriter, r *http.Request, events <-chan Event, last *Event, untilFinal bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(e Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if last != nil {
+		write(*last)
+		return
+	}
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e := <-events:
+			if err := write(e); err != nil {
+				return
+			}
+			if untilFinal && e.final() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+type RequestFunction struct {
+	Definition string `json:"definition"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type FunctionsHandler struct {
+	db database.FunctionStore
+}
+
+func (h *FunctionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/functions"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		h.list(w)
+	case name == "" && r.Method == http.MethodPost:
+		h.define(w, r)
+	case name != "" && r.Method == http.MethodDelete:
+		h.delete(w, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *FunctionsHandler) list(w http.ResponseWriter) {
+	funcs, err := h.db.SelectFunctions(context.TODO(), userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if funcs == nil {
+		funcs = []database.Function{}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(funcs)
+}
+
+func (h *FunctionsHandler) define(w http.ResponseWriter, r *http.Request) {
+	request := new(RequestFunction)
+	defer r.Body.Close()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	funcs, err := h.db.SelectFunctions(context.TODO(), userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := calculation.ParseFunction(request.Definition, funcs...)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+
+	if err := h.db.InsertFunction(context.TODO(), userID, &f); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+func (h *FunctionsHandler) delete(w http.ResponseWriter, name string) {
+	ok, err := h.db.DeleteFunction(context.TODO(), userID, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
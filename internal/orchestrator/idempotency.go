@@ -0,0 +1,81 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// idempotencyLease - сколько ключ остаётся занятым запросом, который не записал ответ.
+	// Запрос сохраняет выражение за доли секунды, дольше он держит ключ, только если
+	// упал вместе с процессом или не смог записать ответ.
+	idempotencyLease = 30 * time.Second
+)
+
+var (
+	errIdempotencyConflict   = errors.New("idempotency key was used with a different request")
+	errIdempotencyInProgress = errors.New("request with this idempotency key is still in progress")
+)
+
+func idempotencyTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL"))
+	if err != nil || ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// requestHash не зависит от пробелов и порядка полей в теле запроса
+func requestHash(request RequestCalc) string {
+	data, _ := json.Marshal(request)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// reserveIdempotencyKey занимает ключ под новый запрос. Если ключ уже использован с тем же
+// телом, возвращает сохранённый ответ и true. Ключ, занятый запросом без ответа дольше
+// idempotencyLease, отдаётся новому запросу.
+func reserveIdempotencyKey(ctx context.Context, db database.IdempotencyStore, userID int64, key, hash string) (database.IdempotencyKey, bool, error) {
+	now := time.Now()
+	if err := db.DeleteExpiredIdempotencyKeys(ctx, userID, now.Add(-idempotencyTTL())); err != nil {
+		return database.IdempotencyKey{}, false, err
+	}
+
+	inserted, err := db.InsertIdempotencyKey(ctx, &database.IdempotencyKey{UserID: userID, Key: key, RequestHash: hash, CreatedAt: now})
+	if err != nil || inserted {
+		return database.IdempotencyKey{}, false, err
+	}
+
+	stored, err := db.SelectIdempotencyKey(ctx, userID, key)
+	if err != nil {
+		return database.IdempotencyKey{}, false, err
+	}
+	if stored.ExpressionID == 0 && now.Sub(stored.CreatedAt) >= idempotencyLease {
+		// Первый запрос так и не записал ответ, выражение он не создал: ключ забирает этот
+		reclaimed, err := db.ReclaimIdempotencyKey(ctx, &database.IdempotencyKey{UserID: userID, Key: key, RequestHash: hash, CreatedAt: now},
+			now.Add(-idempotencyLease))
+		if err != nil || reclaimed {
+			return database.IdempotencyKey{}, false, err
+		}
+		if stored, err = db.SelectIdempotencyKey(ctx, userID, key); err != nil {
+			return database.IdempotencyKey{}, false, err
+		}
+	}
+	if stored.RequestHash != hash {
+		return database.IdempotencyKey{}, false, errIdempotencyConflict
+	}
+	if stored.ExpressionID == 0 {
+		return database.IdempotencyKey{}, false, errIdempotencyInProgress
+	}
+	return stored, true, nil
+}
@@ -0,0 +1,100 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+)
+
+const defaultMaxBodyBytes = 1 << 20
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// configureLimits задаёт ограничения на размер выражений из окружения.
+// Незаданные переменные оставляют значения по умолчанию из calculation.
+func configureLimits() {
+	for name, limit := range map[string]*int{
+		"EXPR_MAX_BYTES":   &calculation.MaxInputBytes,
+		"EXPR_MAX_TOKENS":  &calculation.MaxTokens,
+		"EXPR_MAX_DEPTH":   &calculation.MaxDepth,
+		"EXPR_MAX_ACTIONS": &calculation.MaxActions,
+	} {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+			*limit = n
+		}
+	}
+}
+
+func maxBodyBytes() int64 {
+	n, err := strconv.ParseInt(os.Getenv("REQUEST_MAX_BYTES"), 10, 64)
+	if err != nil || n <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return n
+}
+
+// decodeJSON читает тело запроса не длиннее REQUEST_MAX_BYTES
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes())).Decode(v)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// limitCode возвращает код ошибки для превышенного ограничения или "", если ошибка другая
+func limitCode(err error) string {
+	var qe *QuotaError
+	switch {
+	case errors.As(err, &qe):
+		return qe.Code
+	case errors.Is(err, errBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, calculation.ErrInputTooLarge):
+		return "input_too_large"
+	case errors.Is(err, calculation.ErrTooManyTokens):
+		return "too_many_tokens"
+	case errors.Is(err, calculation.ErrTooDeep):
+		return "too_deep"
+	case errors.Is(err, calculation.ErrTooManyActions):
+		return "too_many_actions"
+	}
+	return ""
+}
+
+// writeLimitError отвечает на превышение ограничения: 429 с Retry-After для лимитов
+// пользователя, 413 для слишком длинного запроса или выражения, 422 для слишком сложного
+// выражения и 500 для остальных ошибок
+func writeLimitError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	code := limitCode(err)
+	var qe *QuotaError
+	switch {
+	case errors.As(err, &qe):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(qe.RetryAfter)))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case code == "body_too_large" || code == "input_too_large":
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case code != "":
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(ResponseError{Code: code, Message: err.Error()})
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
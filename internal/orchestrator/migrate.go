@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+	"github.com/joho/godotenv"
+)
+
+const defaultDatabaseURL = "./database/store.db"
+
+// openStore открывает хранилище по DATABASE_URL: путь к файлу SQLite или postgres://...
+// При STORE=memory данные хранятся в памяти процесса и теряются при остановке.
+func openStore() (database.Store, error) {
+	if os.Getenv("STORE") == "memory" {
+		return database.NewMemoryStore(), nil
+	}
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = defaultDatabaseURL
+	}
+	return database.Open(dsn)
+}
+
+// RunMigrate - подкоманда `orchestrator migrate [status|up]`. status (по умолчанию) показывает,
+// какие миграции применены, up применяет недостающие, не запуская сервер.
+func RunMigrate(args []string) int {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	if cmd != "status" && cmd != "up" {
+		fmt.Fprintf(os.Stderr, "usage: orchestrator migrate [status|up]\n")
+		return 2
+	}
+
+	godotenv.Load()
+	db, err := openStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	if cmd == "up" {
+		applied, err := db.Migrate(context.TODO())
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	statuses, err := db.MigrationStatus(context.TODO())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printMigrationStatus(os.Stdout, statuses)
+	return 0
+}
+
+func printMigrationStatus(w io.Writer, statuses []database.MigrationStatus) {
+	for _, st := range statuses {
+		state := "pending"
+		if st.AppliedAt != nil {
+			state = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%04d_%-20s %s\n", st.Version, st.Name, state)
+	}
+}
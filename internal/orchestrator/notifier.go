@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const maxWait = 2 * time.Minute
+
+var errIncorrectWait = errors.New("incorrect wait duration")
+
+type exprKey struct {
+	userID int64
+	exprID int64
+}
+
+// Notifier будит запросы, ожидающие завершения выражения. SetResult вызывает Notify,
+// когда выражение посчитано или упало с ошибкой.
+type Notifier struct {
+	mu      sync.Mutex
+	waiters map[exprKey][]chan struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{waiters: map[exprKey][]chan struct{}{}}
+}
+
+// Subscribe возвращает канал, который закроется при завершении выражения, и функцию отписки
+func (n *Notifier) Subscribe(userID, exprID int64) (<-chan struct{}, func()) {
+	key := exprKey{userID: userID, exprID: exprID}
+	ch := make(chan struct{})
+
+	n.mu.Lock()
+	n.waiters[key] = append(n.waiters[key], ch)
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for i, c := range n.waiters[key] {
+			if c == ch {
+				n.waiters[key] = append(n.waiters[key][:i], n.waiters[key][i+1:]...)
+				break
+			}
+		}
+		if len(n.waiters[key]) == 0 {
+			delete(n.waiters, key)
+		}
+	}
+}
+
+func (n *Notifier) Notify(userID, exprID int64) {
+	key := exprKey{userID: userID, exprID: exprID}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ch := range n.waiters[key] {
+		close(ch)
+	}
+	delete(n.waiters, key)
+}
+
+func isFinished(status string) bool {
+	return status != "under consideration" && status != "scheduled"
+}
+
+// parseWait читает параметр ?wait=30s, время ожидания ограничено maxWait
+func parseWait(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errIncorrectWait
+	}
+	return min(d, maxWait), nil
+}
+
+// waitExpression ждёт завершения выражения не дольше timeout и возвращает его последнее состояние
+func waitExpression(ctx context.Context, db database.ExpressionStore, notifier *Notifier, userID, exprID int64, timeout time.Duration) (database.Expression, error) {
+	if notifier != nil && timeout > 0 {
+		// Подписка до чтения из базы, чтобы не пропустить завершение между ними
+		done, cancel := notifier.Subscribe(userID, exprID)
+		defer cancel()
+
+		exprs, err := db.SelectExpression(ctx, userID, exprID)
+		if err != nil || len(exprs) == 0 || isFinished(exprs[0].Status) {
+			return firstExpression(exprs, err)
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return firstExpression(db.SelectExpression(context.TODO(), userID, exprID))
+}
+
+func firstExpression(exprs []database.Expression, err error) (database.Expression, error) {
+	if err != nil {
+		return database.Expression{}, err
+	}
+	if len(exprs) == 0 {
+		return database.Expression{}, sql.ErrNoRows
+	}
+	return exprs[0], nil
+}
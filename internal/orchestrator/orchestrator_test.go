@@ -1,36 +1,43 @@
 package orchestrator
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
 	"github.com/hidnt/lms_yandex_final/pkg/database"
+	pb "github.com/hidnt/lms_yandex_final/proto"
+	"google.golang.org/grpc/metadata"
 )
 
-func initDB(t *testing.T) (*sql.DB, func()) {
-	tmpDB, err := os.CreateTemp("", "test.db")
-	if err != nil {
-		t.Fatalf("Cannot create temp file: %v", err)
+// initDB по умолчанию возвращает хранилище в памяти; TEST_STORE=sqlite запускает тесты на файле SQLite
+func initDB(t *testing.T) (database.Store, func()) {
+	if os.Getenv("TEST_STORE") != "sqlite" {
+		return database.NewMemoryStore(), func() {}
 	}
-	defer func() {
-		tmpDB.Close()
-		os.Remove(tmpDB.Name())
-	}()
-
-	os.Setenv("DATABASE_NAME", tmpDB.Name())
 
-	db, err := sql.Open("sqlite3", tmpDB.Name())
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
 		t.Fatalf("Cannot open db: %v", err)
 	}
 
-	if err := database.CreateTables(context.Background(), db); err != nil {
+	if _, err := db.Migrate(context.Background()); err != nil {
 		t.Fatalf("Cannot create tables: %v", err)
 	}
 
@@ -178,3 +185,1264 @@ func TestUserFlow(t *testing.T) {
 		t.Errorf("Unexpected status code after invalid expression: %v", resp.StatusCode)
 	}
 }
+
+func loginAs(t testing.TB, db database.Store, username string) int64 {
+	id, err := db.InsertUser(context.Background(), &database.User{Username: username, Password: "pass"})
+	if err != nil {
+		t.Fatalf("Cannot insert user: %v", err)
+	}
+	userID, hasSession = id, true
+	t.Cleanup(func() {
+		userID, hasSession = 0, false
+	})
+	return id
+}
+
+// completeTask считает задачу так же, как вычислитель, и отправляет результат
+func completeTask(t testing.TB, server *Server, task *pb.TaskRequest) {
+	resp := &pb.TaskResponse{ID: task.ID, ExpressionId: task.ExpressionId, UserID: task.UserID}
+	switch task.Operation {
+	case "+":
+		resp.Res = task.Arg1 + task.Arg2
+	case "-":
+		resp.Res = task.Arg1 - task.Arg2
+	case "*":
+		resp.Res = task.Arg1 * task.Arg2
+	case "/":
+		if task.Arg2 == 0 {
+			resp.Error = true
+		} else {
+			resp.Res = task.Arg1 / task.Arg2
+		}
+	}
+	if _, err := server.SetResult(context.Background(), resp); err != nil {
+		t.Fatalf("Cannot set result: %v", err)
+	}
+}
+
+func TestExpressionActions(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "dag")
+
+	calcHandler := &CalcHandler{db: db}
+	idHandler := &ExpressionsIdHandler{db: db}
+
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2*3"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after correct expression: %v", rec.Code)
+	}
+
+	// Вычислитель забирает первое действие (2*3) и возвращает результат
+	server := &Server{db: db}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("agent", "test-agent"))
+	task, err := server.GetTask(ctx, &pb.Empty{})
+	if err != nil {
+		t.Fatalf("Cannot get task: %v", err)
+	}
+	if _, err := server.SetResult(ctx, &pb.TaskResponse{ID: task.ID, ExpressionId: task.ExpressionId, UserID: task.UserID, Res: 6}); err != nil {
+		t.Fatalf("Cannot set result: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	idHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions/:1/actions", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code for actions: %v", rec.Code)
+	}
+	var dag ResponseActions
+	if err := json.NewDecoder(rec.Body).Decode(&dag); err != nil {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	if len(dag.Actions) != 2 {
+		t.Fatalf("want 2 actions, have %d", len(dag.Actions))
+	}
+	first, second := dag.Actions[0], dag.Actions[1]
+	if first.Status != "completed" || first.Result != 6 || first.Agent != "test-agent" || first.StartedAt == nil || first.FinishedAt == nil {
+		t.Errorf("Unexpected first action: %+v", first)
+	}
+	if second.Status != "ready" || second.IdDepends[1] != 1 {
+		t.Errorf("Unexpected second action: %+v", second)
+	}
+
+	rec = httptest.NewRecorder()
+	idHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions/1/actions?format=dot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code for dot: %v", rec.Code)
+	}
+	dot := rec.Body.String()
+	if !strings.HasPrefix(dot, "digraph expression_1 {") || !strings.Contains(dot, "a1 -> a2;") {
+		t.Errorf("Unexpected dot output: %s", dot)
+	}
+}
+
+func TestRerun(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "rerun")
+
+	scheduler := NewScheduler(db)
+	server := &Server{db: db, scheduler: scheduler}
+	calcHandler := &CalcHandler{db: db, scheduler: scheduler}
+	idHandler := &ExpressionsIdHandler{db: db, scheduler: scheduler}
+	define := func(definition string) {
+		f, err := calculation.ParseFunction(definition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.InsertFunction(context.Background(), userID, &f)
+	}
+	do := func(method, path string) (*httptest.ResponseRecorder, database.Expression) {
+		rec := httptest.NewRecorder()
+		idHandler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var resp database.Expression
+		json.NewDecoder(bytes.NewReader(rec.Body.Bytes())).Decode(&resp)
+		return rec, resp
+	}
+	compare := func(id int64) ResponseCompare {
+		rec, _ := do("GET", fmt.Sprintf("/api/v1/expressions/%d/compare", id))
+		var resp ResponseCompare
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected status code for compare: %v", rec.Code)
+		}
+		return resp
+	}
+
+	define("double(x) = x * 2")
+	submit(t, calcHandler, "double(3)+1")
+	drain(t, server)
+
+	// Повтор считает сохранённый граф, а не новое определение функции
+	define("double(x) = x * 3")
+	rec, resp := do("POST", "/api/v1/expressions/1/rerun")
+	if rec.Code != http.StatusCreated || resp.ID != 2 || resp.RerunOf != 1 {
+		t.Fatalf("Unexpected response for rerun: %v %+v", rec.Code, resp)
+	}
+	if c := compare(2); c.SameStatus || c.Rerun.Status != "under consideration" {
+		t.Fatalf("Unexpected comparison before calculation: %+v", c)
+	}
+	if n := drain(t, server); n != 2 {
+		t.Fatalf("want 2 tasks of rerun, have %d", n)
+	}
+	if c := compare(2); !c.SameResult || c.Original.Result != 7 || c.Rerun.Result != 7 || c.Rerun.Expression != "double(3)+1" || c.Rerun.RerunOf != 1 {
+		t.Fatalf("Unexpected comparison: %+v", c)
+	}
+
+	if rec, _ := do("GET", "/api/v1/expressions/1/compare"); rec.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code for compare of original: %v", rec.Code)
+	}
+	if rec, _ := do("GET", "/api/v1/expressions/1/rerun"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status code for GET rerun: %v", rec.Code)
+	}
+
+	// Выражение без действий разбирается заново из текста
+	rec = httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1+"}`)))
+	if rec, resp := do("POST", "/api/v1/expressions/3/rerun"); rec.Code != http.StatusUnprocessableEntity || resp.RerunOf != 3 {
+		t.Errorf("Unexpected response for rerun of invalid expression: %v %+v", rec.Code, resp)
+	}
+
+	rec = httptest.NewRecorder()
+	(&ExpressionsHandler{db: db}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions?rerun_of=1", nil))
+	var list ResponseExpressions
+	json.NewDecoder(rec.Body).Decode(&list)
+	if list.Total != 1 || list.Expressions[0].ID != 2 {
+		t.Errorf("Unexpected reruns of expression: %+v", list)
+	}
+}
+
+func TestScriptVariables(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "script")
+
+	calcHandler := &CalcHandler{db: db}
+	idHandler := &ExpressionsIdHandler{db: db}
+
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "rate = 0.2; k = 1 + rate; 1200 * k"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after script: %v", rec.Code)
+	}
+
+	server := &Server{db: db}
+	task, err := server.GetTask(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatalf("Cannot get task: %v", err)
+	}
+	if _, err := server.SetResult(context.Background(), &pb.TaskResponse{ID: task.ID, ExpressionId: task.ExpressionId, UserID: task.UserID, Res: task.Arg1 + task.Arg2}); err != nil {
+		t.Fatalf("Cannot set result: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	idHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions/:1", nil))
+	var exprs []database.Expression
+	if err := json.NewDecoder(rec.Body).Decode(&exprs); err != nil || len(exprs) != 1 {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	want := []database.Variable{
+		{Name: "rate", ActionID: -1, Value: 0.2, Completed: true},
+		{Name: "k", ActionID: 1, Value: 1.2, Completed: true},
+	}
+	if !slices.Equal(exprs[0].Variables, want) {
+		t.Errorf("want variables %v, have %v", want, exprs[0].Variables)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "analyst")
+
+	functionsHandler := &FunctionsHandler{db: db}
+	calcHandler := &CalcHandler{db: db}
+
+	rec := httptest.NewRecorder()
+	functionsHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/functions", bytes.NewBufferString(`{"definition": "vat(x) = x * 1.2"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after definition: %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	functionsHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/functions", bytes.NewBufferString(`{"definition": "loop(x) = loop(x) + 1"}`)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Unexpected status code after recursive definition: %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	functionsHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/functions", nil))
+	var funcs []database.Function
+	if err := json.NewDecoder(rec.Body).Decode(&funcs); err != nil {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	if len(funcs) != 1 || funcs[0].Name != "vat" {
+		t.Fatalf("Unexpected functions: %v", funcs)
+	}
+
+	rec = httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "vat(100)"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after expression with function: %v", rec.Code)
+	}
+	actions, _ := db.SelectActions(context.Background(), userID, 1)
+	if len(actions) != 1 || actions[0].Arg1 != 100 || actions[0].Arg2 != 1.2 || actions[0].Operation != "*" {
+		t.Fatalf("Function was not inlined: %v", actions)
+	}
+
+	rec = httptest.NewRecorder()
+	functionsHandler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/v1/functions/vat", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code after delete: %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "vat(100)"}`)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Unexpected status code after deleted function: %v", rec.Code)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "batch")
+
+	batchHandler := &BatchHandler{db: db}
+
+	rec := httptest.NewRecorder()
+	body := `[{"expression": "1+1"}, {"expression": "2*"}, {"expression": "3*4-1"}]`
+	batchHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after batch: %v", rec.Code)
+	}
+
+	var items []ResponseBatchItem
+	if err := json.NewDecoder(rec.Body).Decode(&items); err != nil {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	if len(items) != 3 || items[0].ID != 1 || items[1].Error == "" || items[1].ID != 2 || items[1].Status != items[1].Error || items[2].ID != 3 {
+		t.Fatalf("Unexpected batch response: %+v", items)
+	}
+
+	// Некорректное выражение сохраняется со статусом-ошибкой, как в /calculate
+	exprs, _ := db.SelectExpressions(context.Background(), userID)
+	if len(exprs) != 3 {
+		t.Fatalf("want 3 expressions, have %d", len(exprs))
+	}
+	if e, _ := db.SelectExpression(context.Background(), userID, 2); len(e) != 1 || e[0].Status != items[1].Error || e[0].CompletedAt == nil {
+		t.Fatalf("Unexpected invalid expression: %+v", e)
+	}
+	if actions, _ := db.SelectActions(context.Background(), userID, 3); len(actions) != 2 {
+		t.Fatalf("want 2 actions for third expression, have %d", len(actions))
+	}
+
+	// Пачка только из некорректных выражений сохраняется, но отвечает 422
+	rec = httptest.NewRecorder()
+	batchHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(`[{"expression": "(1"}]`)))
+	items = nil
+	json.NewDecoder(rec.Body).Decode(&items)
+	if rec.Code != http.StatusUnprocessableEntity || len(items) != 1 || items[0].ID != 4 {
+		t.Fatalf("Unexpected response for invalid batch: %v %+v", rec.Code, items)
+	}
+
+	// callback_url проверяется у каждого выражения, как в /calculate, и результат доставляется
+	// на него после вычисления
+	scheduler := NewScheduler(db)
+	webhooks := &Webhooks{db: db, secret: []byte("secret"), allowPrivate: true}
+	batchHandler = &BatchHandler{db: db, scheduler: scheduler, webhooks: webhooks}
+	rec = httptest.NewRecorder()
+	body = `[{"expression": "5+5", "callback_url": "http://127.0.0.1:9/hook"}, {"expression": "6+6", "callback_url": "ftp://example"}]`
+	batchHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(body)))
+	items = nil
+	json.NewDecoder(rec.Body).Decode(&items)
+	if rec.Code != http.StatusCreated || len(items) != 2 || items[0].ID == 0 || items[1].ID != 0 || items[1].Error != errIncorrectCallback.Error() {
+		t.Fatalf("Unexpected response for batch with callbacks: %v %+v", rec.Code, items)
+	}
+	if e, _ := db.SelectExpression(context.Background(), userID, items[0].ID); len(e) != 1 || e[0].CallbackURL != "http://127.0.0.1:9/hook" {
+		t.Fatalf("Callback is not stored: %+v", e)
+	}
+	if n := drain(t, &Server{db: db, scheduler: scheduler, webhooks: webhooks}); n != 1 {
+		t.Fatalf("want 1 task, have %d", n)
+	}
+	due, _ := db.SelectDueWebhooks(context.Background(), time.Now().Add(time.Second))
+	if len(due) != 1 || due[0].ExpressionID != items[0].ID {
+		t.Fatalf("Webhook of batch expression is not queued: %+v", due)
+	}
+
+	// Без секрета callback_url отклоняется у отдельного выражения
+	batchHandler.webhooks = &Webhooks{db: db, allowPrivate: true}
+	rec = httptest.NewRecorder()
+	batchHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(`[{"expression": "7+7", "callback_url": "http://127.0.0.1:9/hook"}]`)))
+	items = nil
+	json.NewDecoder(rec.Body).Decode(&items)
+	if rec.Code != http.StatusUnprocessableEntity || len(items) != 1 || items[0].ID != 0 || items[0].Error != errNoWebhookSecret.Error() {
+		t.Fatalf("Unexpected response for callback without secret: %v %+v", rec.Code, items)
+	}
+}
+
+func TestWait(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "waiter")
+
+	notifier := NewNotifier()
+	calcHandler := &CalcHandler{db: db, notifier: notifier}
+	idHandler := &ExpressionsIdHandler{db: db, notifier: notifier}
+	server := &Server{db: db, notifier: notifier}
+
+	// Без вычислителя ожидание заканчивается по таймауту
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate?wait=50ms", bytes.NewBufferString(`{"expression": "2+2*3"}`)))
+	var resp database.Expression
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	if rec.Code != http.StatusCreated || resp.ID != 1 || resp.Status != "under consideration" {
+		t.Fatalf("Unexpected response after timeout: %v %+v", rec.Code, resp)
+	}
+
+	done := make(chan []database.Expression)
+	go func() {
+		rec := httptest.NewRecorder()
+		idHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions/1?wait=10s", nil))
+		var exprs []database.Expression
+		json.NewDecoder(rec.Body).Decode(&exprs)
+		done <- exprs
+	}()
+
+	for range 2 {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			t.Fatalf("Cannot get task: %v", err)
+		}
+		completeTask(t, server, task)
+	}
+
+	select {
+	case exprs := <-done:
+		if len(exprs) != 1 || exprs[0].Status != "completed" || exprs[0].Result != 8 {
+			t.Fatalf("Unexpected expression after wait: %+v", exprs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait was not released by SetResult")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "dashboard")
+
+	hub := NewHub()
+	calcHandler := &CalcHandler{db: db}
+	idHandler := &ExpressionsIdHandler{db: db, hub: hub}
+	eventsHandler := &EventsHandler{hub: hub}
+	server := &Server{db: db, hub: hub}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/events" {
+			eventsHandler.ServeHTTP(w, r)
+		} else {
+			idHandler.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2*3"}`)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	userStream, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatalf("Cannot create request: %v", err)
+	}
+	userResp, err := http.DefaultClient.Do(userStream)
+	if err != nil {
+		t.Fatalf("Cannot open user stream: %v", err)
+	}
+	exprResp, err := http.Get(ts.URL + "/api/v1/expressions/1/events")
+	if err != nil {
+		t.Fatalf("Cannot open expression stream: %v", err)
+	}
+	defer exprResp.Body.Close()
+	if ct := exprResp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %s", ct)
+	}
+
+	for range 2 {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			t.Fatalf("Cannot get task: %v", err)
+		}
+		completeTask(t, server, task)
+	}
+
+	// Поток выражения закрывается сервером после итогового события
+	body, err := io.ReadAll(exprResp.Body)
+	if err != nil {
+		t.Fatalf("Cannot read expression stream: %v", err)
+	}
+	var types []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if e, ok := strings.CutPrefix(line, "event: "); ok {
+			types = append(types, e)
+		}
+	}
+	want := []string{EventActionClaimed, EventActionCompleted, EventActionClaimed, EventActionCompleted, EventExpressionCompleted}
+	if !slices.Equal(types, want) {
+		t.Fatalf("want events %v, have %v", want, types)
+	}
+
+	// Пользовательский поток живёт, пока клиент не отключится
+	reader := bufio.NewReader(userResp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "event: "+EventActionClaimed+"\n" {
+		t.Fatalf("Unexpected first user event: %q %v", line, err)
+	}
+	cancel()
+	userResp.Body.Close()
+
+	// Завершённое выражение сразу отдаёт итоговое событие
+	resp, err := http.Get(ts.URL + "/api/v1/expressions/1/events")
+	if err != nil {
+		t.Fatalf("Cannot open expression stream: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(body), "event: "+EventExpressionCompleted+"\n") || !strings.Contains(string(body), `"result":8`) {
+		t.Fatalf("Unexpected stream for finished expression: %s", body)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+
+	// GetTask раздаёт задачи вошедшего пользователя
+	loginAs(t, db, "ws")
+
+	hub := NewHub()
+	server := &Server{db: db, hub: hub}
+	ts := httptest.NewServer(&WSHandler{db: db, hub: hub})
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/ws"
+
+	// Без токена соединение не устанавливается
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized handshake, have %v", err)
+	}
+
+	token, err := CreateToken("ws", "pass")
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() WSMessage {
+		var m WSMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("Cannot read message: %v", err)
+		}
+		return m
+	}
+
+	conn.WriteJSON(WSMessage{Type: "submit", RequestID: "a", Expression: "2+2*3"})
+	if m := read(); m.Type != "submitted" || m.RequestID != "a" || m.ID != 1 {
+		t.Fatalf("Unexpected submit reply: %+v", m)
+	}
+
+	conn.WriteJSON(WSMessage{Type: "submit", RequestID: "b", Expression: "2+"})
+	if m := read(); m.Type != "error" || m.RequestID != "b" || m.ID != 2 {
+		t.Fatalf("Unexpected reply for invalid expression: %+v", m)
+	}
+
+	conn.WriteJSON(WSMessage{Type: "subscribe", RequestID: "c", ID: 42})
+	if m := read(); m.Type != "error" || m.RequestID != "c" {
+		t.Fatalf("Unexpected reply for unknown expression: %+v", m)
+	}
+
+	// Сохранение идёт через ту же базу, что и у CalcHandler, и задачи раздаются вычислителям
+	for range 2 {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			t.Fatalf("Cannot get task: %v", err)
+		}
+		completeTask(t, server, task)
+	}
+	if m := read(); m.Type != "result" || m.ID != 1 || m.Status != "completed" || m.Result != 8 {
+		t.Fatalf("Unexpected result push: %+v", m)
+	}
+
+	conn.WriteJSON(WSMessage{Type: "subscribe", RequestID: "d", ID: 1})
+	if m := read(); m.Type != "subscribed" || m.RequestID != "d" {
+		t.Fatalf("Unexpected subscribe reply: %+v", m)
+	}
+	if m := read(); m.Type != "result" || m.Result != 8 {
+		t.Fatalf("Unexpected result for finished expression: %+v", m)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "hooks")
+
+	secret := []byte("secret")
+	type delivery struct {
+		attempt   string
+		signature string
+		payload   WebhookPayload
+		valid     bool
+	}
+	received := make(chan delivery, 10)
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		d := delivery{attempt: r.Header.Get(AttemptHeader), signature: r.Header.Get(SignatureHeader)}
+		d.valid = d.signature == Sign(secret, body)
+		json.Unmarshal(body, &d.payload)
+		received <- d
+
+		// Первые две попытки получатель "не справляется"
+		calls++
+		if calls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	webhooks := &Webhooks{db: db, client: receiver.Client(), secret: secret, maxAttempts: 5, baseDelay: 10 * time.Millisecond, allowPrivate: true, kick: make(chan struct{}, 1)}
+	calcHandler := &CalcHandler{db: db, webhooks: webhooks}
+	server := &Server{db: db, webhooks: webhooks}
+
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1/0", "callback_url": "ftp://example"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Unexpected status code for incorrect callback: %v", rec.Code)
+	}
+
+	body := fmt.Sprintf(`{"expression": "1/0", "callback_url": %q}`, receiver.URL)
+	rec = httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after expression: %v", rec.Code)
+	}
+
+	task, err := server.GetTask(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatalf("Cannot get task: %v", err)
+	}
+	completeTask(t, server, task)
+
+	// Очередь разбирается по шагам: после первой неудачи orchestrator "перезапускается",
+	// и новый Webhooks продолжает доставку из базы
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if i == 2 {
+			webhooks = &Webhooks{db: db, client: receiver.Client(), secret: secret, maxAttempts: 5, baseDelay: 10 * time.Millisecond, allowPrivate: true}
+		}
+		if _, err := webhooks.Deliver(context.Background(), now); err != nil {
+			t.Fatalf("Cannot deliver webhook: %v", err)
+		}
+		webhooks.inFlight.Wait()
+		next, err := db.SelectNextWebhookAttempt(context.Background())
+		if err != nil {
+			t.Fatalf("Cannot select next attempt: %v", err)
+		}
+		select {
+		case d := <-received:
+			if d.attempt != strconv.Itoa(i) || !d.valid || d.payload.ID != 1 || d.payload.Status != "division by zero" {
+				t.Fatalf("Unexpected delivery %d: %+v", i, d)
+			}
+		default:
+			t.Fatalf("Delivery %d was not sent", i)
+		}
+		if (i < 3) != (next != nil) {
+			t.Fatalf("Unexpected next attempt after delivery %d: %v", i, next)
+		}
+		if next != nil {
+			if !next.After(now) {
+				t.Fatalf("Retry %d is not delayed: %v", i, next)
+			}
+			now = *next
+		}
+	}
+
+	deliveries, _ := db.SelectWebhookDeliveries(context.Background(), userID, 1)
+	if len(deliveries) != 3 || deliveries[0].StatusCode != http.StatusServiceUnavailable || deliveries[0].Error == "" ||
+		deliveries[2].StatusCode != http.StatusOK || deliveries[2].Error != "" {
+		t.Fatalf("Unexpected recorded deliveries: %+v", deliveries)
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "unsigned")
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unsigned webhook was sent")
+	}))
+	defer receiver.Close()
+
+	// Без секрета callback_url отклоняется
+	webhooks := &Webhooks{db: db, client: receiver.Client(), maxAttempts: 3, allowPrivate: true}
+	rec := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"expression": "1+1", "callback_url": %q}`, receiver.URL)
+	(&CalcHandler{db: db, webhooks: webhooks}).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errNoWebhookSecret.Error()) {
+		t.Fatalf("Unexpected response for callback without secret: %v %s", rec.Code, rec.Body.String())
+	}
+
+	// Доставка, поставленная в очередь при заданном секрете, не отправляется и не повторяется
+	now := time.Now()
+	exprID, err := db.InsertExpression(context.Background(), userID, &database.Expression{Status: "completed", Result: 1, CompletedAt: &now, CallbackURL: receiver.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Enqueue(context.Background(), userID, exprID)
+	if _, err := webhooks.Deliver(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Cannot deliver webhook: %v", err)
+	}
+	webhooks.inFlight.Wait()
+	if next, err := db.SelectNextWebhookAttempt(context.Background()); err != nil || next != nil {
+		t.Fatalf("Unsigned webhook is retried: %v %v", next, err)
+	}
+	deliveries, _ := db.SelectWebhookDeliveries(context.Background(), userID, exprID)
+	if len(deliveries) != 1 || deliveries[0].Error != errNoWebhookSecret.Error() {
+		t.Fatalf("Unexpected recorded deliveries: %+v", deliveries)
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "slow hooks")
+
+	unblock := make(chan struct{})
+	slowCalls := make(chan struct{}, 10)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowCalls <- struct{}{}
+		<-unblock
+	}))
+	defer slow.Close()
+	fast := make(chan struct{}, 1)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast <- struct{}{}
+	}))
+	defer good.Close()
+
+	webhooks := &Webhooks{db: db, client: &http.Client{Timeout: 5 * time.Second}, secret: []byte("secret"), maxAttempts: 1, allowPrivate: true}
+	defer func() {
+		close(unblock)
+		webhooks.inFlight.Wait()
+	}()
+	now := time.Now()
+	for _, callback := range []string{slow.URL, slow.URL, slow.URL, good.URL} {
+		exprID, err := db.InsertExpression(context.Background(), userID, &database.Expression{Status: "completed", Result: 1, CompletedAt: &now, CallbackURL: callback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		webhooks.Enqueue(context.Background(), userID, exprID)
+	}
+	if _, err := webhooks.Deliver(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Cannot deliver webhooks: %v", err)
+	}
+
+	// Пока медленный получатель не ответил, другой получает свой результат
+	select {
+	case <-fast:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Webhook is delayed by a slow receiver")
+	}
+	for range webhookHostWorkers {
+		<-slowCalls
+	}
+	select {
+	case <-slowCalls:
+		t.Fatalf("More than %d attempts to one host at once", webhookHostWorkers)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCallbackAddresses(t *testing.T) {
+	wh := &Webhooks{secret: []byte("secret")}
+	tests := []struct {
+		callback string
+		want     error
+	}{
+		{"", nil},
+		{"http://93.184.216.34/hook", nil},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/hook", nil},
+		{"ftp://93.184.216.34", errIncorrectCallback},
+		{"http://localhost:8080", errPrivateCallback},
+		{"http://127.0.0.2", errPrivateCallback},
+		{"http://169.254.169.254/latest/meta-data", errPrivateCallback},
+		{"http://10.1.2.3", errPrivateCallback},
+		{"http://172.16.0.1", errPrivateCallback},
+		{"http://192.168.1.1", errPrivateCallback},
+		{"http://[::1]:9000", errPrivateCallback},
+		{"http://[::ffff:127.0.0.1]", errPrivateCallback},
+		{"http://0.0.0.0", errPrivateCallback},
+	}
+	if err := (*Webhooks)(nil).validateCallback(context.Background(), "http://93.184.216.34/hook"); !errors.Is(err, errNoWebhookSecret) {
+		t.Errorf("Callback is accepted without webhooks: %v", err)
+	}
+	for _, tt := range tests {
+		if err := wh.validateCallback(context.Background(), tt.callback); !errors.Is(err, tt.want) {
+			t.Errorf("validateCallback(%q) = %v, want %v", tt.callback, err, tt.want)
+		}
+	}
+
+	// Адрес проверяется и при соединении: имя могло разрешиться иначе, чем при проверке
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request to a private address was sent")
+	}))
+	defer receiver.Close()
+	_, err := publicClient(time.Second).Post(receiver.URL, "application/json", nil)
+	if !errors.Is(err, errPrivateCallback) {
+		t.Fatalf("Unexpected error for a private address: %v", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "retry")
+
+	calcHandler := &CalcHandler{db: db}
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		calcHandler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := post("k1", `{"expression": "2+2"}`)
+	if first.Code != http.StatusCreated || first.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Fatalf("Unexpected first response: %v", first.Code)
+	}
+
+	// Повтор с тем же телом (пробелы не важны) возвращает тот же ответ
+	repeat := post("k1", `{ "expression":"2+2" }`)
+	if repeat.Code != http.StatusCreated || repeat.Header().Get(IdempotencyReplayedHeader) != "true" || repeat.Body.String() != first.Body.String() {
+		t.Fatalf("Unexpected replay: %v %s", repeat.Code, repeat.Body.String())
+	}
+
+	if conflict := post("k1", `{"expression": "3+3"}`); conflict.Code != http.StatusConflict {
+		t.Fatalf("Unexpected status code for different body: %v", conflict.Code)
+	}
+
+	// Код ответа тоже повторяется
+	invalid := post("k2", `{"expression": "3+"}`)
+	if replay := post("k2", `{"expression": "3+"}`); invalid.Code != http.StatusUnprocessableEntity || replay.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Unexpected status codes for invalid expression: %v %v", invalid.Code, replay.Code)
+	}
+
+	if exprs, _ := db.SelectExpressions(context.Background(), userID); len(exprs) != 2 {
+		t.Fatalf("want 2 expressions, have %d", len(exprs))
+	}
+
+	// Ключ, занятый запросом, который не записал ответ, освобождается после idempotencyLease
+	db.InsertIdempotencyKey(context.Background(), &database.IdempotencyKey{UserID: userID, Key: "k3", RequestHash: "crashed", CreatedAt: time.Now()})
+	if busy := post("k3", `{"expression": "4+4"}`); busy.Code != http.StatusConflict {
+		t.Fatalf("Unexpected status code for key in progress: %v", busy.Code)
+	}
+	db.DeleteIdempotencyKey(context.Background(), userID, "k3")
+	db.InsertIdempotencyKey(context.Background(), &database.IdempotencyKey{UserID: userID, Key: "k3", RequestHash: "crashed",
+		CreatedAt: time.Now().Add(-idempotencyLease - time.Second)})
+	if taken := post("k3", `{"expression": "4+4"}`); taken.Code != http.StatusCreated || taken.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Fatalf("Unexpected response for stale key: %v", taken.Code)
+	}
+	if replay := post("k3", `{"expression": "4+4"}`); replay.Header().Get(IdempotencyReplayedHeader) != "true" {
+		t.Fatalf("Reclaimed key is not replayed: %v", replay.Code)
+	}
+
+	// После TTL ключ можно использовать заново
+	t.Setenv("IDEMPOTENCY_TTL", "1ms")
+	time.Sleep(5 * time.Millisecond)
+	if again := post("k1", `{"expression": "3+3"}`); again.Code != http.StatusCreated || again.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Fatalf("Unexpected response after TTL: %v", again.Code)
+	}
+}
+
+func TestExpressionsList(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "list")
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	statuses := []string{"completed", "under consideration", "division by zero", "completed", "completed"}
+	for i, status := range statuses {
+		// Время создания идёт в обратном порядке, чтобы сортировки по id и по created различались
+		created := base.Add(time.Duration(len(statuses)-i) * time.Hour)
+		expr := database.Expression{Status: status, CreatedAt: &created}
+		if _, err := db.InsertExpression(context.Background(), userID, &expr); err != nil {
+			t.Fatalf("Cannot insert expression: %v", err)
+		}
+	}
+
+	handler := &ExpressionsHandler{db: db}
+	list := func(query string) (int, ResponseExpressions) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions?"+query, nil))
+		var resp ResponseExpressions
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	ids := func(exprs []database.Expression) []int64 {
+		var ids []int64
+		for _, e := range exprs {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	// Обход всех страниц по времени создания
+	var got []int64
+	query := "sort=created&limit=2"
+	for pages := 0; ; pages++ {
+		code, resp := list(query)
+		if code != http.StatusOK || resp.Total != 5 || pages > 3 {
+			t.Fatalf("Unexpected page: %v %+v", code, resp)
+		}
+		got = append(got, ids(resp.Expressions)...)
+		if resp.NextCursor == "" {
+			break
+		}
+		query = "sort=created&limit=2&cursor=" + resp.NextCursor
+	}
+	if !slices.Equal(got, []int64{5, 4, 3, 2, 1}) {
+		t.Fatalf("Unexpected order: %v", got)
+	}
+
+	if _, resp := list("order=desc&limit=2"); !slices.Equal(ids(resp.Expressions), []int64{5, 4}) || resp.NextCursor == "" {
+		t.Fatalf("Unexpected descending page: %+v", resp)
+	}
+
+	if _, resp := list("status=failed"); resp.Total != 1 || !slices.Equal(ids(resp.Expressions), []int64{3}) {
+		t.Fatalf("Unexpected failed filter: %+v", resp)
+	}
+	if _, resp := list("status=completed&created_from=" + base.Add(3*time.Hour).Format(time.RFC3339)); resp.Total != 1 || !slices.Equal(ids(resp.Expressions), []int64{1}) {
+		t.Fatalf("Unexpected created filter: %+v", resp)
+	}
+
+	// Курсор от другой сортировки и некорректные параметры
+	_, resp := list("sort=created&limit=1")
+	for _, q := range []string{"cursor=" + resp.NextCursor, "cursor=abc", "limit=0", "sort=result", "order=up", "created_to=yesterday"} {
+		if code, _ := list(q); code != http.StatusBadRequest {
+			t.Fatalf("Unexpected status code for %q: %v", q, code)
+		}
+	}
+}
+
+func TestExpressionTimes(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "times")
+
+	calcHandler := &CalcHandler{db: db}
+	idHandler := &ExpressionsIdHandler{db: db}
+	server := &Server{db: db}
+
+	rec := httptest.NewRecorder()
+	calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2+2*3"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code after correct expression: %v", rec.Code)
+	}
+
+	get := func() database.Expression {
+		rec := httptest.NewRecorder()
+		idHandler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/expressions/1", nil))
+		var exprs []database.Expression
+		if err := json.NewDecoder(rec.Body).Decode(&exprs); err != nil || len(exprs) != 1 {
+			t.Fatalf("Cannot decode response: %v", err)
+		}
+		return exprs[0]
+	}
+
+	expr := get()
+	if expr.Expression != "2+2*3" || expr.CreatedAt == nil || expr.StartedAt != nil || expr.CompletedAt != nil {
+		t.Fatalf("Unexpected pending expression: %+v", expr)
+	}
+
+	for range 2 {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			t.Fatalf("Cannot get task: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		completeTask(t, server, task)
+	}
+
+	expr = get()
+	if expr.Status != "completed" || expr.StartedAt == nil || expr.CompletedAt == nil || expr.ComputeMs < 10 {
+		t.Fatalf("Unexpected completed expression: %+v", expr)
+	}
+	if expr.StartedAt.Before(*expr.CreatedAt) || expr.CompletedAt.Before(*expr.StartedAt) {
+		t.Errorf("Unexpected timestamps: %v %v %v", expr.CreatedAt, expr.StartedAt, expr.CompletedAt)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "recover")
+
+	calcHandler := &CalcHandler{db: db}
+	for _, expression := range []string{"2+2*3", "1+1"} {
+		rec := httptest.NewRecorder()
+		calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Unexpected status code after correct expression: %v", rec.Code)
+		}
+	}
+
+	// Вычислители забирают по действию из каждого выражения, после чего orchestrator падает:
+	// результат первого не доходит, а у второго успевает записаться только действие
+	crashed := &Server{db: db}
+	first, err := crashed.GetTask(context.Background(), &pb.Empty{})
+	if err != nil || first.ExpressionId != 1 {
+		t.Fatalf("Cannot get task: %+v %v", first, err)
+	}
+	second, err := crashed.GetTask(context.Background(), &pb.Empty{})
+	if err != nil || second.ExpressionId != 2 {
+		t.Fatalf("Cannot get task: %+v %v", second, err)
+	}
+	db.UpdateActionResult(context.Background(), userID, 2, second.ID, 2)
+	db.UpdateActionStatus(context.Background(), userID, 2, second.ID, true, false)
+
+	server := &Server{db: db}
+	if _, err := server.GetTask(context.Background(), &pb.Empty{}); err == nil {
+		t.Fatalf("Orphaned action is handed out before recovery")
+	}
+
+	report, err := server.Recover(context.Background())
+	if err != nil {
+		t.Fatalf("Cannot recover: %v", err)
+	}
+	if report != (RecoveryReport{Expressions: 2, Released: 1, Completed: 1}) {
+		t.Fatalf("Unexpected recovery report: %+v", report)
+	}
+
+	exprs, _ := db.SelectExpression(context.Background(), userID, 2)
+	if exprs[0].Status != "completed" || exprs[0].Result != 2 || exprs[0].CompletedAt == nil {
+		t.Fatalf("Unexpected recovered expression: %+v", exprs[0])
+	}
+
+	// Действие первого выражения выдаётся заново, и выражение досчитывается
+	task, err := server.GetTask(context.Background(), &pb.Empty{})
+	if err != nil || task.ExpressionId != 1 || task.ID != first.ID {
+		t.Fatalf("Released action is not handed out again: %+v %v", task, err)
+	}
+	completeTask(t, server, task)
+	task, err = server.GetTask(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatalf("Cannot get task: %v", err)
+	}
+	completeTask(t, server, task)
+
+	exprs, _ = db.SelectExpression(context.Background(), userID, 1)
+	if exprs[0].Status != "completed" || exprs[0].Result != 8 {
+		t.Fatalf("Unexpected expression after recovery: %+v", exprs[0])
+	}
+
+	// Повторный запуск ничего не находит
+	if report, err := server.Recover(context.Background()); err != nil || report != (RecoveryReport{}) {
+		t.Fatalf("Unexpected second recovery: %+v %v", report, err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "quotas")
+
+	t.Setenv("QUOTA_RPS", "1")
+	t.Setenv("QUOTA_BURST", "2")
+	t.Setenv("QUOTA_MAX_PENDING", "2")
+	t.Setenv("QUOTA_MAX_ACTIONS", "")
+	quotas := NewQuotas(db)
+	handler := quotas.Middleware((&CalcHandler{db: db, quotas: quotas}).ServeHTTP)
+
+	calc := func(expression string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		return rec
+	}
+
+	// Два запроса проходят сразу, третий упирается в частоту
+	for range 2 {
+		if rec := calc("1+1"); rec.Code != http.StatusCreated {
+			t.Fatalf("Unexpected status code within burst: %v", rec.Code)
+		}
+	}
+	rec := calc("1+1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Unexpected response over rate limit: %v %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Личный лимит из базы заменяет общий. Ведро пусто, поэтому частота проверяется заново
+	burst, pending, actions := 100, 3, 2
+	db.InsertQuota(context.Background(), &database.Quota{UserID: userID, Burst: &burst, MaxPending: &pending, MaxActions: &actions})
+	quotas = NewQuotas(db)
+	handler = quotas.Middleware((&CalcHandler{db: db, quotas: quotas}).ServeHTTP)
+
+	rec = calc("1+2+3+4")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), calculation.ErrTooManyActions.Error()) {
+		t.Fatalf("Unexpected response over action limit: %v %s", rec.Code, rec.Body.String())
+	}
+	if rec := calc("1+1"); rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code within personal limits: %v", rec.Code)
+	}
+	rec = calc("1+1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "5" {
+		t.Fatalf("Unexpected response over pending limit: %v %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if n, _ := db.CountExpressions(context.Background(), userID, database.ExpressionFilter{}); n != 3 {
+		t.Fatalf("Rejected expressions are stored: %d", n)
+	}
+
+	// Некорректные выражения не занимают лимит невычисленных
+	if rec := calc("1+"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Unexpected status code after incorrect expression: %v", rec.Code)
+	}
+
+	// Пачка проверяется целиком
+	batch := &BatchHandler{db: db, quotas: quotas}
+	rec = httptest.NewRecorder()
+	batch.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(`[{"expression": "2+2"}]`)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected batch status code over pending limit: %v", rec.Code)
+	}
+}
+
+func TestQuotaBuckets(t *testing.T) {
+	quotas := &Quotas{buckets: make(map[int64]*bucket)}
+	fast := Limits{RPS: 1, Burst: 2}
+	slow := Limits{RPS: 0.001, Burst: 2}
+	now := time.Now()
+
+	// Первое ведро наполняется за две секунды, второе - за полчаса
+	quotas.Allow(1, fast, now)
+	quotas.Allow(1, fast, now)
+	quotas.Allow(2, slow, now)
+	quotas.Allow(3, fast, now.Add(bucketSweepInterval))
+
+	if _, ok := quotas.buckets[1]; ok {
+		t.Fatalf("Refilled bucket is not evicted")
+	}
+	if _, ok := quotas.buckets[2]; !ok {
+		t.Fatalf("Bucket is evicted before it is refilled")
+	}
+	if ok, _ := quotas.Allow(2, slow, now.Add(bucketSweepInterval)); !ok {
+		t.Fatalf("Unexpected rate limit")
+	}
+	if ok, _ := quotas.Allow(2, slow, now.Add(bucketSweepInterval)); ok {
+		t.Fatalf("Bucket is refilled by the sweep")
+	}
+}
+
+func TestQuotaConcurrentSubmit(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "concurrent")
+
+	t.Setenv("QUOTA_RPS", "")
+	t.Setenv("QUOTA_MAX_PENDING", "3")
+	quotas := NewQuotas(slowCountStore{db})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := submitExpression(context.Background(), db, nil, quotas, nil, userID, RequestCalc{Expression: "1+1"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		} else if limitCode(err) != "too_many_pending" {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if n, _ := db.CountExpressions(context.Background(), userID, database.ExpressionFilter{}); accepted != 3 || n != 3 {
+		t.Fatalf("Pending limit is exceeded: accepted %d, stored %d", accepted, n)
+	}
+	if len(quotas.submits) != 0 {
+		t.Fatalf("Submit locks are not released: %d", len(quotas.submits))
+	}
+}
+
+// slowCountStore растягивает подсчёт невычисленных, чтобы одновременные запросы успели пересечься
+type slowCountStore struct {
+	quotaStore
+}
+
+func (s slowCountStore) CountExpressions(ctx context.Context, userID int64, filter database.ExpressionFilter) (int64, error) {
+	n, err := s.quotaStore.CountExpressions(ctx, userID, filter)
+	time.Sleep(10 * time.Millisecond)
+	return n, err
+}
+
+func TestQuotaArgs(t *testing.T) {
+	var q database.Quota
+	if err := parseQuotaArgs(&q, []string{"rps=2.5", "pending=10", "actions=0"}); err != nil {
+		t.Fatal(err)
+	}
+	if *q.RPS != 2.5 || *q.MaxPending != 10 || *q.MaxActions != 0 || q.Burst != nil {
+		t.Fatalf("Unexpected quota: %+v", q)
+	}
+	if err := parseQuotaArgs(&q, []string{"pending=default"}); err != nil || q.MaxPending != nil {
+		t.Fatalf("Limit is not reset to default: %+v %v", q, err)
+	}
+	for _, args := range []string{"rps", "rps=-1", "burst=x", "speed=1"} {
+		if err := parseQuotaArgs(&q, []string{args}); err == nil {
+			t.Errorf("Incorrect argument %q is accepted", args)
+		}
+	}
+}
+
+// untouchedStore не отдаёт функции пользователя и не сохраняет выражения: выражения,
+// не прошедшие проверки до разбора, не должны доходить до базы
+type untouchedStore struct {
+	database.Store
+}
+
+func (untouchedStore) SelectFunctions(ctx context.Context, userID int64) ([]database.Function, error) {
+	return nil, errors.New("functions are not expected to be loaded")
+}
+
+func (untouchedStore) InsertExpressions(ctx context.Context, userID int64, exprs []database.Expression) ([]int64, error) {
+	return nil, errors.New("expressions are not expected to be stored")
+}
+
+func TestInputLimits(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "limits")
+
+	t.Setenv("REQUEST_MAX_BYTES", "256")
+	t.Setenv("EXPR_MAX_DEPTH", "2")
+	defer func(depth int) { calculation.MaxDepth = depth }(calculation.MaxDepth)
+	configureLimits()
+
+	calcHandler := &CalcHandler{db: db}
+	testCases := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "large body", body: `{"expression": "` + strings.Repeat("1+", 200) + `1"}`, wantStatus: http.StatusRequestEntityTooLarge, wantCode: "body_too_large"},
+		{name: "deep expression", body: `{"expression": "(((1+1)))"}`, wantStatus: http.StatusUnprocessableEntity, wantCode: "too_deep"},
+		{name: "within limits", body: `{"expression": "((1+1))"}`, wantStatus: http.StatusCreated},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			calcHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(testCase.body)))
+			if rec.Code != testCase.wantStatus {
+				t.Fatalf("Unexpected status code: %v", rec.Code)
+			}
+			var resp ResponseError
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Code != testCase.wantCode {
+				t.Fatalf("Unexpected error code: %q", resp.Code)
+			}
+		})
+	}
+
+	// Отклонённые выражения не сохраняются
+	if n, _ := db.CountExpressions(context.Background(), userID, database.ExpressionFilter{}); n != 1 {
+		t.Fatalf("Rejected expressions are stored: %d", n)
+	}
+
+	// Длина и число токенов проверяются, не обращаясь к функциям пользователя в базе
+	t.Setenv("EXPR_MAX_TOKENS", "8")
+	defer func(tokens int) { calculation.MaxTokens = tokens }(calculation.MaxTokens)
+	configureLimits()
+	untouched := untouchedStore{db}
+	if _, err := submitExpression(context.Background(), untouched, nil, nil, nil, userID, RequestCalc{Expression: "1+1+1+1+1"}); limitCode(err) != "too_many_tokens" {
+		t.Fatalf("Unexpected error for too many tokens: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	(&SchedulesHandler{db: untouched}).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/schedules", bytes.NewBufferString(`{"expression": "1+1+1+1+1", "cron": "* * * * *"}`)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "too_many_tokens") {
+		t.Fatalf("Unexpected schedule response for too many tokens: %v %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	(&BatchHandler{db: untouched}).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(`[{"expression": "1+1+1+1+1"}]`)))
+	var rejected []ResponseBatchItem
+	json.NewDecoder(rec.Body).Decode(&rejected)
+	if rec.Code != http.StatusUnprocessableEntity || len(rejected) != 1 || rejected[0].ID != 0 || rejected[0].Code != "too_many_tokens" {
+		t.Fatalf("Unexpected batch response for too many tokens: %v %+v", rec.Code, rejected)
+	}
+
+	rec = httptest.NewRecorder()
+	(&BatchHandler{db: db}).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate/batch", bytes.NewBufferString(`[{"expression": "1+1"}, {"expression": "(((1)))"}]`)))
+	var items []ResponseBatchItem
+	if err := json.NewDecoder(rec.Body).Decode(&items); err != nil || len(items) != 2 {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+	if items[0].ID == 0 || items[1].ID != 0 || items[1].Code != "too_deep" {
+		t.Fatalf("Unexpected batch response: %+v", items)
+	}
+}
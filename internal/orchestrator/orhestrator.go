@@ -2,14 +2,16 @@ package orchestrator
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/hidnt/lms_yandex_final/pkg/calculation"
@@ -18,6 +20,8 @@ import (
 	"github.com/joho/godotenv"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 var (
@@ -25,6 +29,8 @@ var (
 	userID     int64
 )
 
+var errInvalidExpression = errors.New("invalid expression")
+
 type RequestSignInOut struct {
 	Username string `json:"login,omitempty"`
 	Password string `json:"password,omitempty"`
@@ -32,12 +38,26 @@ type RequestSignInOut struct {
 }
 
 type RequestCalc struct {
-	Expression string `json:"expression"`
+	Expression  string     `json:"expression"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	RunAt       *time.Time `json:"run_at,omitempty"`
+	Delay       string     `json:"delay,omitempty"`
+	// ScheduleID и RerunOf - расписание, запустившее выражение, и выражение, которое
+	// оно повторяет; клиент их не передаёт
+	ScheduleID int64 `json:"-"`
+	RerunOf    int64 `json:"-"`
 }
 
 type Server struct {
 	pb.OrchestratorServer
-	db *sql.DB
+	db       database.Store
+	notifier *Notifier
+	hub      *Hub
+	webhooks *Webhooks
+	// scheduler раздаёт действия из памяти; без него GetTask ищет готовые действия в базе
+	scheduler *Scheduler
+	cache     *ResultCache
 }
 
 func NewServer() *Server {
@@ -45,21 +65,45 @@ func NewServer() *Server {
 }
 
 func (s *Server) SetResult(ctx context.Context, in *pb.TaskResponse) (*pb.Empty, error) {
+	agent := agentName(ctx)
+	return s.setResult(ctx, in, agent, agent)
+}
+
+// setResult принимает результат действия, выданного вычислителю claimedBy. В событиях
+// действие посчитано вычислителем by: для результата из кэша это cacheAgent.
+func (s *Server) setResult(ctx context.Context, in *pb.TaskResponse, claimedBy, by string) (*pb.Empty, error) {
 	log.Printf("Expression %d, task %d was completed", in.ExpressionId, in.ID)
 
+	if s.scheduler != nil {
+		return s.setScheduledResult(ctx, in, claimedBy, by)
+	}
+
 	if in.Error {
-		database.UpdateExpression(ctx, s.db, in.UserID, in.ExpressionId, &database.Expression{Status: "division by zero", Result: 0})
+		now := time.Now()
+		s.db.UpdateActionFinished(ctx, in.UserID, in.ExpressionId, in.ID, now)
+		actions, _ := s.db.SelectActions(ctx, in.UserID, in.ExpressionId)
+		s.db.UpdateExpression(ctx, in.UserID, in.ExpressionId, &database.Expression{Status: "division by zero", Result: 0,
+			CompletedAt: &now, ComputeMs: computeMs(actions)})
+		s.cache.PutActions(actions, now)
+		s.notify(in.UserID, in.ExpressionId)
+		s.webhooks.Enqueue(ctx, in.UserID, in.ExpressionId)
+		s.publish(Event{Type: EventExpressionFailed, UserID: in.UserID, ExpressionID: in.ExpressionId, ActionID: in.ID, Status: "division by zero"})
 	} else {
-		err := database.UpdateActionResult(context.TODO(), s.db, in.UserID, in.ExpressionId, in.ID, in.Res)
+		err := s.db.UpdateActionResult(context.TODO(), in.UserID, in.ExpressionId, in.ID, in.Res)
 		if err != nil {
 			return &pb.Empty{}, err
 		}
-		err = database.UpdateActionStatus(ctx, s.db, in.UserID, in.ExpressionId, in.ID, true, false)
+		err = s.db.UpdateActionStatus(ctx, in.UserID, in.ExpressionId, in.ID, true, false)
 		if err != nil {
 			return &pb.Empty{}, err
 		}
+		err = s.db.UpdateActionFinished(ctx, in.UserID, in.ExpressionId, in.ID, time.Now())
+		if err != nil {
+			return &pb.Empty{}, err
+		}
+		s.publish(Event{Type: EventActionCompleted, UserID: in.UserID, ExpressionID: in.ExpressionId, ActionID: in.ID, Agent: by, Result: in.Res})
 
-		actions, err := database.SelectActions(ctx, s.db, in.UserID, in.ExpressionId)
+		actions, err := s.db.SelectActions(ctx, in.UserID, in.ExpressionId)
 		if err != nil {
 			return &pb.Empty{}, err
 		}
@@ -72,24 +116,106 @@ func (s *Server) SetResult(ctx context.Context, in *pb.TaskResponse) (*pb.Empty,
 		}
 
 		if complete == len(actions) {
-			database.UpdateExpression(ctx, s.db, in.UserID, in.ExpressionId, &database.Expression{Status: "completed",
-				Result: actions[len(actions)-1].Result})
+			now := time.Now()
+			s.db.UpdateExpression(ctx, in.UserID, in.ExpressionId, &database.Expression{Status: "completed",
+				Result: actions[len(actions)-1].Result, CompletedAt: &now, ComputeMs: computeMs(actions)})
+			s.cache.PutActions(actions, now)
+			s.notify(in.UserID, in.ExpressionId)
+			s.webhooks.Enqueue(ctx, in.UserID, in.ExpressionId)
+			s.publish(Event{Type: EventExpressionCompleted, UserID: in.UserID, ExpressionID: in.ExpressionId, Status: "completed", Result: actions[len(actions)-1].Result})
 		}
 	}
 
 	return &pb.Empty{}, nil
 }
 
+// setScheduledResult - SetResult при работе через Scheduler: действие сохранится при очередном сбросе,
+// а закончившееся выражение записывается сразу, после всех своих действий.
+func (s *Server) setScheduledResult(ctx context.Context, in *pb.TaskResponse, claimedBy, by string) (*pb.Empty, error) {
+	finished, actions, ok := s.scheduler.Complete(in.UserID, in.ExpressionId, in.ID, claimedBy, in.Res, in.Error, time.Now())
+	if !ok {
+		return &pb.Empty{}, fmt.Errorf("unknown task")
+	}
+	if !in.Error {
+		s.publish(Event{Type: EventActionCompleted, UserID: in.UserID, ExpressionID: in.ExpressionId, ActionID: in.ID, Agent: by, Result: in.Res})
+	}
+	if finished == nil {
+		return &pb.Empty{}, nil
+	}
+
+	if err := s.scheduler.Flush(ctx); err != nil {
+		return &pb.Empty{}, err
+	}
+	finished.ComputeMs = computeMs(actions)
+	if err := s.db.UpdateExpression(ctx, in.UserID, in.ExpressionId, finished); err != nil {
+		return &pb.Empty{}, err
+	}
+	s.cache.PutActions(actions, *finished.CompletedAt)
+
+	s.notify(in.UserID, in.ExpressionId)
+	s.webhooks.Enqueue(ctx, in.UserID, in.ExpressionId)
+	if in.Error {
+		s.publish(Event{Type: EventExpressionFailed, UserID: in.UserID, ExpressionID: in.ExpressionId, ActionID: in.ID, Status: finished.Status})
+	} else {
+		s.publish(Event{Type: EventExpressionCompleted, UserID: in.UserID, ExpressionID: in.ExpressionId, Status: finished.Status, Result: finished.Result})
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) notify(userID, exprID int64) {
+	if s.notifier != nil {
+		s.notifier.Notify(userID, exprID)
+	}
+}
+
+func (s *Server) publish(e Event) {
+	if s.hub != nil {
+		s.hub.Publish(e)
+	}
+}
+
 func (s *Server) GetTask(ctx context.Context, in *pb.Empty) (*pb.TaskRequest, error) {
-	exprs, err := database.SelectExpressions(ctx, s.db, userID)
+	agent := agentName(ctx)
+	for {
+		action, cacheable, err := s.nextTask(ctx, agent)
+		if err != nil {
+			return &pb.TaskRequest{}, err
+		}
+		if cacheable && s.cache != nil {
+			if res, ok := s.cache.Get(action.UserID, calculation.ActionKey(action.Operation, action.Arg1, action.Arg2), time.Now()); ok {
+				// Результат уже известен: действие завершается без вычислителя
+				in := &pb.TaskResponse{ID: action.ID, ExpressionId: action.ExpressionID, UserID: action.UserID, Res: res}
+				if _, err := s.setResult(ctx, in, agent, cacheAgent); err != nil {
+					log.Printf("cached result of expression %d, task %d: %v", action.ExpressionID, action.ID, err)
+				}
+				continue
+			}
+		}
+		s.publish(Event{Type: EventActionClaimed, UserID: action.UserID, ExpressionID: action.ExpressionID, ActionID: action.ID, Agent: agent})
+		return taskRequest(action), nil
+	}
+}
+
+// nextTask забирает следующее готовое действие с подставленными аргументами. cacheable
+// равен false для повторных запусков, которые должны считаться вычислителями.
+func (s *Server) nextTask(ctx context.Context, agent string) (database.Action, bool, error) {
+	if s.scheduler != nil {
+		action, ok := s.scheduler.Next(agent, time.Now())
+		if !ok {
+			return database.Action{}, false, fmt.Errorf("no available task")
+		}
+		return action, s.scheduler.cacheable(action.UserID, action.ExpressionID), nil
+	}
+
+	exprs, err := s.db.SelectExpressions(ctx, userID)
 	if err != nil {
-		return &pb.TaskRequest{}, nil
+		return database.Action{}, false, err
 	}
 
 	for _, expr := range exprs {
-		actions, err := database.SelectActions(ctx, s.db, userID, expr.ID)
+		actions, err := s.db.SelectActions(ctx, userID, expr.ID)
 		if err != nil {
-			return &pb.TaskRequest{}, fmt.Errorf("no available task")
+			return database.Action{}, false, fmt.Errorf("no available task")
 		}
 		for _, action := range actions {
 			if !action.NowCalculate && !action.Completed && expr.Status == "under consideration" {
@@ -99,61 +225,70 @@ func (s *Server) GetTask(ctx context.Context, in *pb.Empty) (*pb.TaskRequest, er
 				if action.IdDepends[1] != -1 && !actions[action.IdDepends[1]-1].Completed {
 					continue
 				}
-				task := pb.TaskRequest{ID: action.ID, ExpressionId: action.ExpressionID, UserID: action.UserID, Operation: action.Operation}
-
-				switch task.Operation {
-				case "*":
-					n := os.Getenv("TIME_MULTIPLICATIONS_MS")
-					t, err := strconv.ParseInt(n, 10, 32)
-					if err != nil {
-						t = 1000
-					}
-					task.OperationTime = int32(t)
-				case "/":
-					n := os.Getenv("TIME_DIVISIONS_MS")
-					t, err := strconv.ParseInt(n, 10, 32)
-					if err != nil {
-						t = 1000
-					}
-					task.OperationTime = int32(t)
-				case "+":
-					n := os.Getenv("TIME_ADDITION_MS")
-					t, err := strconv.ParseInt(n, 10, 32)
-					if err != nil {
-						t = 1000
-					}
-					task.OperationTime = int32(t)
-				case "-":
-					n := os.Getenv("TIME_SUBTRACTION_MS")
-					t, err := strconv.ParseInt(n, 10, 32)
-					if err != nil {
-						t = 1000
-					}
-					task.OperationTime = int32(t)
-				}
-
-				if action.IdDepends[0] == -1 {
-					task.Arg1 = action.Arg1
-				} else {
+				task := action
+				if action.IdDepends[0] != -1 {
 					task.Arg1 = actions[action.IdDepends[0]-1].Result
 				}
-
-				if action.IdDepends[1] == -1 {
-					task.Arg2 = action.Arg2
-				} else {
+				if action.IdDepends[1] != -1 {
 					task.Arg2 = actions[action.IdDepends[1]-1].Result
 				}
 
-				database.UpdateActionStatus(ctx, s.db, userID, action.ExpressionID, action.ID, false, true)
-				return &task, nil
+				now := time.Now()
+				claimed, err := s.db.ClaimAction(ctx, userID, action.ExpressionID, action.ID, agent, now)
+				if err != nil || !claimed {
+					// Действие успел забрать другой вычислитель
+					continue
+				}
+				s.db.UpdateExpressionStarted(ctx, userID, action.ExpressionID, now)
+				return task, expr.RerunOf == 0, nil
 			}
 		}
 	}
 
-	return &pb.TaskRequest{}, fmt.Errorf("no available task")
+	return database.Action{}, false, fmt.Errorf("no available task")
+}
+
+// taskRequest собирает задачу для вычислителя из действия с уже подставленными аргументами
+func taskRequest(a database.Action) *pb.TaskRequest {
+	return &pb.TaskRequest{ID: a.ID, ExpressionId: a.ExpressionID, UserID: a.UserID, Operation: a.Operation,
+		Arg1: a.Arg1, Arg2: a.Arg2, OperationTime: operationTime(a.Operation)}
+}
+
+func operationTime(op string) int32 {
+	var n string
+	switch op {
+	case "*":
+		n = os.Getenv("TIME_MULTIPLICATIONS_MS")
+	case "/":
+		n = os.Getenv("TIME_DIVISIONS_MS")
+	case "+":
+		n = os.Getenv("TIME_ADDITION_MS")
+	case "-":
+		n = os.Getenv("TIME_SUBTRACTION_MS")
+	default:
+		return 0
+	}
+	t, err := strconv.ParseInt(n, 10, 32)
+	if err != nil {
+		t = 1000
+	}
+	return int32(t)
+}
+
+// agentName берёт имя вычислителя из метаданных запроса, а если его нет - адрес клиента.
+func agentName(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("agent"); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
 }
 
-func StartGRPC(port string, db *sql.DB) {
+func StartGRPC(port string, server *Server) {
 	addr := fmt.Sprintf("localhost:%s", port)
 	lis, err := net.Listen("tcp", addr)
 
@@ -163,9 +298,6 @@ func StartGRPC(port string, db *sql.DB) {
 	}
 
 	grpcServer := grpc.NewServer()
-	server := NewServer()
-
-	server.db = db
 
 	pb.RegisterOrchestratorServer(grpcServer, server)
 
@@ -184,38 +316,81 @@ func StartOrchestrator() {
 
 	portHTTP := os.Getenv("PORT_HTTP")
 	portGRPC := os.Getenv("PORT_GRPC")
+	configureLimits()
 
-	db, err := sql.Open("sqlite3", "./database/store.db")
+	db, err := openStore()
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 	defer db.Close()
 
-	if _, err := db.ExecContext(context.TODO(), "PRAGMA foreign_keys = ON;"); err != nil {
+	applied, err := db.Migrate(context.TODO())
+	if err != nil {
 		log.Fatal(err)
 	}
+	for _, m := range applied {
+		log.Printf("Применена миграция %04d_%s", m.Version, m.Name)
+	}
+
+	notifier := NewNotifier()
+	hub := NewHub()
+	webhooks := NewWebhooks(db)
+	scheduler := NewScheduler(db)
+	quotas := NewQuotas(db)
+	cache := resultCacheFromEnv()
+	promoter := NewPromoter(db, scheduler, hub)
+	runner := NewScheduleRunner(db, scheduler, quotas, cache)
+
+	server := NewServer()
+	server.db = db
+	server.notifier = notifier
+	server.hub = hub
+	server.webhooks = webhooks
+	server.scheduler = scheduler
+	server.cache = cache
 
-	if err := db.PingContext(context.TODO()); err != nil {
+	report, err := server.Recover(context.TODO())
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	if err := database.CreateTables(context.TODO(), db); err != nil {
+	if report.Expressions > 0 {
+		log.Printf("Восстановление после перезапуска: %s", report)
+	}
+	if err := scheduler.Load(context.TODO()); err != nil {
 		log.Fatal(err)
 	}
+	go scheduler.Run(context.TODO())
+	go promoter.Run(context.TODO())
+	go runner.Run(context.TODO())
+	go webhooks.Run(context.TODO())
 
-	go StartGRPC(portGRPC, db)
+	go StartGRPC(portGRPC, server)
 
 	signUpHandler := &SignUpHandler{db: db}
 	signInHandler := &SignInHandler{db: db}
-	calcHandler := &CalcHandler{db: db}
+	calcHandler := &CalcHandler{db: db, notifier: notifier, webhooks: webhooks, scheduler: scheduler, quotas: quotas, promoter: promoter, cache: cache}
 	expressionsHandler := &ExpressionsHandler{db: db}
-	expressionsIdHandler := &ExpressionsIdHandler{db: db}
+	expressionsIdHandler := &ExpressionsIdHandler{db: db, notifier: notifier, hub: hub, scheduler: scheduler, quotas: quotas}
+	eventsHandler := &EventsHandler{hub: hub}
+	wsHandler := &WSHandler{db: db, hub: hub, scheduler: scheduler, quotas: quotas, cache: cache}
+	functionsHandler := &FunctionsHandler{db: db}
+	batchHandler := &BatchHandler{db: db, scheduler: scheduler, quotas: quotas, promoter: promoter, cache: cache, webhooks: webhooks}
+	cacheHandler := &CacheHandler{cache: cache}
+	schedulesHandler := &SchedulesHandler{db: db, runner: runner}
 
 	http.Handle("/api/v1/register", signUpHandler)
 	http.Handle("/api/v1/login", signInHandler)
-	http.Handle("/api/v1/calculate", AuthMiddleware(calcHandler.ServeHTTP))
+	http.Handle("/api/v1/calculate", AuthMiddleware(quotas.Middleware(calcHandler.ServeHTTP)))
+	http.Handle("/api/v1/calculate/batch", AuthMiddleware(quotas.Middleware(batchHandler.ServeHTTP)))
 	http.Handle("/api/v1/expressions", AuthMiddleware(expressionsHandler.ServeHTTP))
 	http.Handle("/api/v1/expressions/", AuthMiddleware(expressionsIdHandler.ServeHTTP))
+	http.Handle("/api/v1/ws", wsHandler)
+	http.Handle("/api/v1/events", AuthMiddleware(eventsHandler.ServeHTTP))
+	http.Handle("/api/v1/functions", AuthMiddleware(functionsHandler.ServeHTTP))
+	http.Handle("/api/v1/functions/", AuthMiddleware(functionsHandler.ServeHTTP))
+	http.Handle("/api/v1/schedules", AuthMiddleware(schedulesHandler.ServeHTTP))
+	http.Handle("/api/v1/schedules/", AuthMiddleware(schedulesHandler.ServeHTTP))
+	http.Handle("/api/v1/cache", AuthMiddleware(cacheHandler.ServeHTTP))
 
 	http.Handle("/api/v1/", http.StripPrefix("/api/v1", http.FileServer(http.Dir("./static"))))
 
@@ -234,7 +409,7 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 }
 
 type SignUpHandler struct {
-	db *sql.DB
+	db database.Store
 }
 
 func (h *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -242,14 +417,14 @@ func (h *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	request := new(RequestSignInOut)
 	defer r.Body.Close()
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
 		return
 	}
 
 	u := database.User{Username: request.Username, Password: request.Password}
 
-	if _, err := database.InsertUser(context.TODO(), h.db, &u); err != nil {
+	if _, err := h.db.InsertUser(context.TODO(), &u); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -258,7 +433,7 @@ func (h *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type SignInHandler struct {
-	db *sql.DB
+	db database.Store
 }
 
 func (h *SignInHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -266,8 +441,8 @@ func (h *SignInHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	request := new(RequestSignInOut)
 	defer r.Body.Close()
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
 		return
 	}
 
@@ -293,7 +468,7 @@ func (h *SignInHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		username = request.Username
 		password = request.Password
 	}
-	u, err := database.SelectUser(context.TODO(), h.db, username)
+	u, err := h.db.SelectUser(context.TODO(), username)
 	if err != nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
@@ -356,7 +531,13 @@ func DecodeToken(tokenString string) (map[string]interface{}, error) {
 }
 
 type CalcHandler struct {
-	db *sql.DB
+	db        database.Store
+	notifier  *Notifier
+	webhooks  *Webhooks
+	scheduler *Scheduler
+	quotas    *Quotas
+	promoter  *Promoter
+	cache     *ResultCache
 }
 
 func (h *CalcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -364,67 +545,278 @@ func (h *CalcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	request := new(RequestCalc)
 	defer r.Body.Close()
 
-	err := json.NewDecoder(r.Body).Decode(&request)
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	wait, err := parseWait(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	expr, err := calculation.Calc(request.Expression)
+	if err := h.webhooks.validateCallback(r.Context(), request.CallbackURL); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+	if err := validatePriority(request.Priority); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+	if _, err := runAt(*request, time.Now()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key != "" {
+		stored, replay, err := reserveIdempotencyKey(context.TODO(), h.db, userID, key, requestHash(*request))
+		if errors.Is(err, errIdempotencyConflict) || errors.Is(err, errIdempotencyInProgress) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if replay {
+			w.Header().Set(IdempotencyReplayedHeader, "true")
+			w.WriteHeader(stored.StatusCode)
+			json.NewEncoder(w).Encode(database.Expression{ID: stored.ExpressionID})
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	resp, err := submitExpression(context.TODO(), h.db, h.scheduler, h.quotas, h.cache, userID, *request)
+	if errors.Is(err, errInvalidExpression) {
+		status = http.StatusUnprocessableEntity
+	} else if err != nil {
+		if key != "" {
+			h.db.DeleteIdempotencyKey(context.TODO(), userID, key)
+		}
+		writeLimitError(w, err)
+		return
+	}
+
+	if key != "" {
+		h.db.UpdateIdempotencyKey(context.TODO(), userID, key, resp.ID, status)
+	}
+	if resp.RunAt != nil {
+		h.promoter.Wake()
+	}
+
+	if status == http.StatusCreated && resp.Status != "" {
+		h.webhooks.Enqueue(context.TODO(), userID, resp.ID)
+	} else if status == http.StatusCreated && wait > 0 {
+		if e, err := waitExpression(r.Context(), h.db, h.notifier, userID, resp.ID, wait); err == nil {
+			resp.Status = e.Status
+			resp.Result = e.Result
+		}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(database.Expression{ID: resp.ID, Status: resp.Status, Result: resp.Result, RunAt: resp.RunAt})
+}
+
+// submitExpression разбирает и сохраняет выражение пользователя. Некорректное выражение тоже
+// сохраняется, со статусом-ошибкой, и тогда вместе с ним возвращается errInvalidExpression.
+// Status и Result заполнены, только если выражение уже посчитано на сервере, RunAt - если оно отложено.
+// Если выражение не проходит лимиты пользователя, оно не сохраняется.
+func submitExpression(ctx context.Context, db calcStore, sched *Scheduler, quotas *Quotas, cache *ResultCache, userID int64, request RequestCalc) (database.Expression, error) {
+	// Длина и число токенов проверяются до обращения к базе
+	if err := calculation.CheckInput(request.Expression); err != nil {
+		return database.Expression{}, err
+	}
+	funcs, err := db.SelectFunctions(ctx, userID)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		expr.Status = fmt.Sprint(err)
-	} else {
-		w.WriteHeader(http.StatusCreated)
+		return database.Expression{}, err
+	}
+
+	expr, calcErr := buildExpression(request.Expression, funcs)
+	if limitCode(calcErr) != "" {
+		// Слишком большие выражения отклоняются, не попадая в базу
+		return database.Expression{}, calcErr
+	}
+	if calcErr != nil {
+		now := time.Now()
+		expr.Status = fmt.Sprint(calcErr)
+		expr.CompletedAt = &now
+	}
+	expr.CallbackURL = request.CallbackURL
+	expr.Priority = request.Priority
+	expr.ScheduleID = request.ScheduleID
+	expr.RerunOf = request.RerunOf
+	if calcErr == nil {
+		expr = cache.Apply(userID, expr, time.Now())
+	}
+	if calcErr == nil && len(expr.Actions) > 0 {
+		at, err := runAt(request, time.Now())
+		if err != nil {
+			return database.Expression{}, err
+		}
+		if at != nil {
+			expr.Status = "scheduled"
+			expr.RunAt = at
+		}
+	}
+
+	// Некорректное выражение в лимиты не входит
+	var actions []int
+	if calcErr == nil {
+		actions = []int{len(expr.Actions)}
+	}
+
+	// Выражение, действия и переменные сохраняются одной транзакцией: вычислители
+	// не увидят выражение, пока оно не записано целиком
+	var ids []int64
+	err = quotas.Submit(ctx, userID, actions, func() (err error) {
+		ids, err = db.InsertExpressions(ctx, userID, []database.Expression{expr})
+		return err
+	})
+	if err != nil {
+		return database.Expression{}, err
 	}
+	exprID := ids[0]
+	if calcErr == nil && expr.RunAt == nil {
+		sched.Add(userID, exprID, expr)
+	}
+
+	if calcErr != nil {
+		return database.Expression{ID: exprID, Status: expr.Status}, fmt.Errorf("%w: %w", errInvalidExpression, calcErr)
+	}
+
+	resp := database.Expression{ID: exprID, RunAt: expr.RunAt}
+	if len(expr.Actions) == 0 {
+		resp.Status = expr.Status
+		resp.Result = expr.Result
+	}
+	return resp, nil
+}
+
+// calcStore - то, что нужно для разбора и сохранения выражений: функции пользователя и выражения
+type calcStore interface {
+	database.ExpressionStore
+	database.FunctionStore
+}
+
+// buildExpression разбивает выражение на действия и сразу сворачивает то, что можно посчитать на сервере
+func buildExpression(expression string, funcs []database.Function) (database.Expression, error) {
+	expr, err := calculation.Calc(expression, funcs...)
+	expr.Expression = expression
+	if err != nil {
+		return expr, err
+	}
+	expr = calculation.Fold(expr, foldMaxActions())
+	expr.Expression = expression
+	if isFinished(expr.Status) {
+		now := time.Now()
+		expr.CompletedAt = &now
+	}
+	return expr, nil
+}
 
-	exprID, _ := database.InsertExpression(context.TODO(), h.db, userID, &expr)
-	for _, a := range expr.Actions {
-		database.InsertActions(context.TODO(), h.db, exprID, userID, &a)
+func foldMaxActions() int {
+	n, err := strconv.Atoi(os.Getenv("FOLD_MAX_ACTIONS"))
+	if err != nil || n < 0 {
+		return 0
 	}
-	json.NewEncoder(w).Encode(database.Expression{ID: exprID})
+	return n
 }
 
 type ExpressionsHandler struct {
-	db *sql.DB
+	db database.Store
 }
 
 func (h *ExpressionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	exprs, err := database.SelectExpressions(context.TODO(), h.db, userID)
+	f, err := parseExpressionFilter(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
 		return
 	}
-	json.NewEncoder(w).Encode(exprs)
-	w.WriteHeader(http.StatusOK)
+	writeExpressionsPage(w, h.db, f)
 }
 
 type ExpressionsIdHandler struct {
-	db *sql.DB
+	db        database.Store
+	notifier  *Notifier
+	hub       *Hub
+	scheduler *Scheduler
+	quotas    *Quotas
 }
 
 func (h *ExpressionsIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	exprs, _ := database.SelectExpressions(context.TODO(), h.db, userID)
-	id := r.URL.Path[len("/api/v1/expressions/"):]
-	if id == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(exprs)
-		return
-	}
-	n, err := strconv.ParseInt(id[1:], 10, 64)
+	exprs, _ := h.db.SelectExpressions(context.TODO(), userID)
+	n, sub, err := parseExpressionPath(r.URL.Path)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(exprs)
 		return
 	}
-	expr, err := database.SelectExpression(context.TODO(), h.db, userID, n)
+	expr, err := h.db.SelectExpression(context.TODO(), userID, n)
 	if err != nil || len(expr) == 0 {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(exprs)
 		return
 	}
+
+	switch sub {
+	case "":
+		wait, err := parseWait(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if wait > 0 {
+			e, err := waitExpression(r.Context(), h.db, h.notifier, userID, n, wait)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			expr[0] = e
+		}
+		expr[0].Variables, err = h.db.SelectVariables(context.TODO(), userID, n)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case "actions":
+		h.serveActions(w, r, expr[0])
+		return
+	case "events":
+		if h.hub == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.serveEvents(w, r, expr[0])
+		return
+	case "rerun":
+		h.serveRerun(w, r, expr[0])
+		return
+	case "compare":
+		h.serveCompare(w, expr[0])
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(expr)
 }
+
+// parseExpressionPath разбирает путь вида /api/v1/expressions/:id[/подресурс].
+func parseExpressionPath(path string) (int64, string, error) {
+	rest := strings.TrimPrefix(path, "/api/v1/expressions/")
+	id, sub, _ := strings.Cut(rest, "/")
+	n, err := strconv.ParseInt(strings.TrimPrefix(id, ":"), 10, 64)
+	return n, sub, err
+}
@@ -0,0 +1,175 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+var (
+	errIncorrectLimit  = errors.New("incorrect limit")
+	errIncorrectCursor = errors.New("incorrect cursor")
+	errIncorrectSort   = errors.New("incorrect sort")
+	errIncorrectOrder  = errors.New("incorrect order")
+	errIncorrectTime   = errors.New("incorrect created_from or created_to")
+	errIncorrectSched  = errors.New("incorrect schedule")
+	errIncorrectRerun  = errors.New("incorrect rerun_of")
+)
+
+type ResponseExpressions struct {
+	Expressions []database.Expression `json:"expressions"`
+	Total       int64                 `json:"total"`
+	NextCursor  string                `json:"next_cursor,omitempty"`
+}
+
+// expressionCursor - позиция последнего выражения страницы. Вместе с ключом запоминаются
+// сортировка и порядок, чтобы курсор нельзя было применить к другой выборке
+type expressionCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d"`
+	Key  int64  `json:"k"`
+	ID   int64  `json:"i"`
+}
+
+func (c expressionCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (expressionCursor, error) {
+	var c expressionCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errIncorrectCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.ID <= 0 {
+		return c, errIncorrectCursor
+	}
+	return c, nil
+}
+
+// parseExpressionFilter читает параметры списка выражений:
+// limit, cursor, status, created_from, created_to, schedule, rerun_of, sort (id, created, completed) и order (asc, desc)
+func parseExpressionFilter(r *http.Request) (database.ExpressionFilter, error) {
+	q := r.URL.Query()
+	f := database.ExpressionFilter{SortBy: "id", Limit: defaultPageLimit}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return f, errIncorrectLimit
+		}
+		f.Limit = min(n, maxPageLimit)
+	}
+
+	if s := q.Get("sort"); s != "" {
+		if s != "id" && s != "created" && s != "completed" {
+			return f, errIncorrectSort
+		}
+		f.SortBy = s
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		f.Desc = true
+	default:
+		return f, errIncorrectOrder
+	}
+
+	switch s := q.Get("status"); s {
+	case "":
+	case "pending":
+		f.Statuses = []string{"under consideration", "scheduled"}
+	case "failed":
+		f.ExceptStatuses = []string{"under consideration", "scheduled", "completed"}
+	default:
+		f.Statuses = []string{s}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"created_from", &f.CreatedFrom}, {"created_to", &f.CreatedTo}} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, errIncorrectTime
+		}
+		*p.dst = t
+	}
+
+	if s := q.Get("schedule"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return f, errIncorrectSched
+		}
+		f.ScheduleID = id
+	}
+	if s := q.Get("rerun_of"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return f, errIncorrectRerun
+		}
+		f.RerunOf = id
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return f, err
+		}
+		if c.Sort != f.SortBy || c.Desc != f.Desc {
+			return f, errIncorrectCursor
+		}
+		f.AfterKey, f.AfterID = c.Key, c.ID
+	}
+
+	return f, nil
+}
+
+// writeExpressionsPage отвечает страницей выражений и их общим количеством
+func writeExpressionsPage(w http.ResponseWriter, db database.ExpressionStore, f database.ExpressionFilter) {
+	// Одно выражение сверх лимита показывает, есть ли следующая страница
+	page := f
+	page.Limit++
+	exprs, err := db.SelectExpressionsPage(context.TODO(), userID, page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	total, err := db.CountExpressions(context.TODO(), userID, f)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := ResponseExpressions{Total: total}
+	resp.Expressions, resp.NextCursor = nextCursor(exprs, f)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// nextCursor обрезает лишнее выражение, выбранное сверх лимита, и возвращает курсор следующей страницы
+func nextCursor(exprs []database.Expression, f database.ExpressionFilter) ([]database.Expression, string) {
+	if len(exprs) <= f.Limit {
+		return exprs, ""
+	}
+	exprs = exprs[:f.Limit]
+	last := exprs[len(exprs)-1]
+	return exprs, expressionCursor{Sort: f.SortBy, Desc: f.Desc, Key: last.SortKey(f.SortBy), ID: last.ID}.encode()
+}
@@ -0,0 +1,117 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+// promoteRetry - через сколько повторить проверку, если база вернула ошибку
+const promoteRetry = time.Second
+
+var errIncorrectRunAt = errors.New("incorrect run_at or delay")
+
+// runAt возвращает, когда запускать выражение: в run_at или через delay от now.
+// nil - сразу; время в прошлом тоже означает запуск сразу.
+func runAt(request RequestCalc, now time.Time) (*time.Time, error) {
+	if request.RunAt != nil && request.Delay != "" {
+		return nil, errIncorrectRunAt
+	}
+	at := request.RunAt
+	if request.Delay != "" {
+		delay, err := time.ParseDuration(request.Delay)
+		if err != nil || delay < 0 {
+			return nil, errIncorrectRunAt
+		}
+		t := now.Add(delay)
+		at = &t
+	}
+	if at == nil || !at.After(now) {
+		return nil, nil
+	}
+	return at, nil
+}
+
+// Promoter выпускает отложенные выражения, когда наступает их run_at: переводит их в
+// "under consideration" и ставит действия в очередь. Время запуска хранится в базе,
+// поэтому выражения, срок которых прошёл, пока orchestrator был остановлен, выпускаются
+// сразу после запуска.
+type Promoter struct {
+	db        database.ExpressionStore
+	scheduler *Scheduler
+	hub       *Hub
+	kick      chan struct{}
+}
+
+func NewPromoter(db database.ExpressionStore, scheduler *Scheduler, hub *Hub) *Promoter {
+	return &Promoter{db: db, scheduler: scheduler, hub: hub, kick: make(chan struct{}, 1)}
+}
+
+// Wake сообщает о новом отложенном выражении, чтобы таймер учёл его время
+func (p *Promoter) Wake() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run выпускает выражения по таймеру, заведённому на ближайший run_at
+func (p *Promoter) Run(ctx context.Context) {
+	runTimer(ctx, p.kick, "promote scheduled expressions", p.Promote)
+}
+
+// runTimer вызывает step сразу, затем во время, которое step вернул, и после каждого
+// сигнала kick. Если step вернул nil, следующий вызов будет только по kick.
+func runTimer(ctx context.Context, kick <-chan struct{}, name string, step func(context.Context, time.Time) (*time.Time, error)) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-kick:
+			timer.Stop()
+		}
+
+		next, err := step(ctx, time.Now())
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			timer.Reset(promoteRetry)
+			continue
+		}
+		if next != nil {
+			timer.Reset(time.Until(*next))
+		}
+	}
+}
+
+// Promote выпускает выражения, время которых наступило к now, и возвращает время
+// следующего отложенного выражения или nil, если их больше нет
+func (p *Promoter) Promote(ctx context.Context, now time.Time) (*time.Time, error) {
+	exprs, err := p.db.PromoteExpressions(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, expr := range exprs {
+		if p.scheduler != nil {
+			actions, err := p.db.SelectActions(ctx, expr.UserID, expr.ID)
+			if err != nil {
+				// Выражение уже выпущено в базе, Scheduler.Load подхватит его при следующем запуске
+				log.Printf("promote expression %d of user %d: %v", expr.ID, expr.UserID, err)
+				continue
+			}
+			p.scheduler.addStored(expr, actions)
+		}
+		if p.hub != nil {
+			p.hub.Publish(Event{Type: EventExpressionReleased, UserID: expr.UserID, ExpressionID: expr.ID, Status: expr.Status})
+		}
+	}
+	return p.db.SelectNextRunAt(ctx)
+}
@@ -0,0 +1,364 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+	"github.com/joho/godotenv"
+)
+
+// pendingRetryAfter - через сколько предлагается повторить запрос, упёршийся в лимит
+// невычисленных выражений: точно сказать, когда они досчитаются, нельзя
+const pendingRetryAfter = 5 * time.Second
+
+// bucketSweepInterval - как часто из памяти убираются вёдра пользователей, которые давно не
+// делали запросов и успели наполниться: полное ведро ничем не отличается от отсутствующего
+const bucketSweepInterval = time.Minute
+
+// QuotaError - превышен лимит, запрос можно повторить через RetryAfter
+type QuotaError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// Limits - лимиты пользователя. 0 - без ограничения
+type Limits struct {
+	RPS        float64 // запросов в секунду
+	Burst      int     // сколько запросов можно сделать подряд, по умолчанию RPS
+	MaxPending int     // невычисленных выражений одновременно
+	MaxActions int     // действий в одном выражении
+}
+
+func defaultLimits() Limits {
+	var l Limits
+	if rps, err := strconv.ParseFloat(os.Getenv("QUOTA_RPS"), 64); err == nil && rps > 0 {
+		l.RPS = rps
+	}
+	l.Burst = envLimit("QUOTA_BURST")
+	l.MaxPending = envLimit("QUOTA_MAX_PENDING")
+	l.MaxActions = envLimit("QUOTA_MAX_ACTIONS")
+	return l
+}
+
+func envLimit(name string) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// override накладывает личные лимиты пользователя на общие
+func (l Limits) override(q database.Quota) Limits {
+	if q.RPS != nil {
+		l.RPS = *q.RPS
+	}
+	if q.Burst != nil {
+		l.Burst = *q.Burst
+	}
+	if q.MaxPending != nil {
+		l.MaxPending = *q.MaxPending
+	}
+	if q.MaxActions != nil {
+		l.MaxActions = *q.MaxActions
+	}
+	return l
+}
+
+func (l Limits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.RPS))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // когда ведро наполнится, если запросов больше не будет
+}
+
+// submitLock - блокировка пользователя на время проверки лимита невычисленных и сохранения
+type submitLock struct {
+	sync.Mutex
+	refs int
+}
+
+// quotaStore - личные лимиты пользователей и их выражения, по которым считаются невычисленные
+type quotaStore interface {
+	database.QuotaStore
+	database.ExpressionStore
+}
+
+// Quotas проверяет лимиты пользователей. Частота запросов считается маркерным ведром
+// в памяти процесса, число невычисленных выражений - по базе.
+type Quotas struct {
+	db       quotaStore
+	defaults Limits
+
+	mu      sync.Mutex
+	buckets map[int64]*bucket
+	swept   time.Time
+	submits map[int64]*submitLock
+}
+
+func NewQuotas(db quotaStore) *Quotas {
+	return &Quotas{db: db, defaults: defaultLimits(), buckets: make(map[int64]*bucket), submits: make(map[int64]*submitLock)}
+}
+
+// Limits возвращает действующие лимиты пользователя
+func (q *Quotas) Limits(ctx context.Context, userID int64) (Limits, error) {
+	if q == nil {
+		return Limits{}, nil
+	}
+	stored, err := q.db.SelectQuota(ctx, userID)
+	if err != nil {
+		return Limits{}, err
+	}
+	return q.defaults.override(stored), nil
+}
+
+// Allow списывает один запрос из ведра пользователя. Если ведро пусто, возвращает,
+// через сколько в нём появится запрос.
+func (q *Quotas) Allow(userID int64, l Limits, now time.Time) (bool, time.Duration) {
+	if q == nil || l.RPS <= 0 {
+		return true, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sweep(now)
+
+	b, ok := q.buckets[userID]
+	if !ok {
+		b = &bucket{tokens: l.burst(), last: now}
+		q.buckets[userID] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst(), b.tokens+elapsed*l.RPS)
+		b.last = now
+	}
+	allowed, wait := false, time.Duration((1-b.tokens)/l.RPS*float64(time.Second))
+	if b.tokens >= 1 {
+		b.tokens--
+		allowed, wait = true, 0
+	}
+	b.full = now.Add(time.Duration((l.burst() - b.tokens) / l.RPS * float64(time.Second)))
+	return allowed, wait
+}
+
+// sweep убирает наполнившиеся вёдра, не чаще раза в bucketSweepInterval. Вызывается под q.mu
+func (q *Quotas) sweep(now time.Time) {
+	if now.Sub(q.swept) < bucketSweepInterval {
+		return
+	}
+	q.swept = now
+	for userID, b := range q.buckets {
+		if !now.Before(b.full) {
+			delete(q.buckets, userID)
+		}
+	}
+}
+
+// Middleware ограничивает частоту запросов пользователя, вошедшего в систему
+func (q *Quotas) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := q.allowRequest(r.Context(), userID); err != nil {
+			writeLimitError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (q *Quotas) allowRequest(ctx context.Context, userID int64) error {
+	if q == nil {
+		return nil
+	}
+	l, err := q.Limits(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if ok, wait := q.Allow(userID, l, time.Now()); !ok {
+		return &QuotaError{Code: "rate_limited", Message: "too many requests", RetryAfter: wait}
+	}
+	return nil
+}
+
+// CheckSubmit проверяет, можно ли добавить выражения с указанным числом действий.
+// Выражения без действий уже посчитаны и в лимит невычисленных не входят, отложенные - входят.
+func (q *Quotas) CheckSubmit(ctx context.Context, userID int64, actions ...int) error {
+	if q == nil {
+		return nil
+	}
+	l, err := q.Limits(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, n := range actions {
+		if l.MaxActions > 0 && n > l.MaxActions {
+			return fmt.Errorf("%w: %d, limit %d", calculation.ErrTooManyActions, n, l.MaxActions)
+		}
+		if n > 0 {
+			pending++
+		}
+	}
+	if l.MaxPending <= 0 || pending == 0 {
+		return nil
+	}
+
+	n, err := q.db.CountExpressions(ctx, userID, database.ExpressionFilter{Statuses: []string{"under consideration", "scheduled"}})
+	if err != nil {
+		return err
+	}
+	if int(n)+pending > l.MaxPending {
+		return &QuotaError{Code: "too_many_pending", Message: fmt.Sprintf("too many pending expressions, limit %d", l.MaxPending), RetryAfter: pendingRetryAfter}
+	}
+	return nil
+}
+
+// Submit проверяет лимиты так же, как CheckSubmit, и сохраняет выражения через insert.
+// Проверка и сохранение идут под блокировкой пользователя, иначе одновременные запросы
+// увидят одно и то же число невычисленных и вместе превысят MaxPending.
+func (q *Quotas) Submit(ctx context.Context, userID int64, actions []int, insert func() error) error {
+	if q == nil {
+		return insert()
+	}
+	unlock := q.lockSubmit(userID)
+	defer unlock()
+
+	if err := q.CheckSubmit(ctx, userID, actions...); err != nil {
+		return err
+	}
+	return insert()
+}
+
+// lockSubmit захватывает блокировку пользователя. Блокировка живёт в памяти, пока её кто-то ждёт
+func (q *Quotas) lockSubmit(userID int64) func() {
+	q.mu.Lock()
+	l, ok := q.submits[userID]
+	if !ok {
+		l = &submitLock{}
+		q.submits[userID] = l
+	}
+	l.refs++
+	q.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		q.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(q.submits, userID)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// RunQuota - подкоманда `orchestrator quota <login> [rps=N] [burst=N] [pending=N] [actions=N] | reset`.
+// Без параметров показывает действующие лимиты пользователя. Параметры задают личные лимиты
+// (значение default возвращает общий), reset удаляет все личные лимиты.
+func RunQuota(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: orchestrator quota <login> [rps=N] [burst=N] [pending=N] [actions=N] | reset\n")
+		return 2
+	}
+
+	godotenv.Load()
+	db, err := openStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.TODO()
+	user, err := db.SelectUser(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %q not found\n", args[0])
+		return 1
+	}
+
+	if len(args) == 2 && args[1] == "reset" {
+		err = db.DeleteQuota(ctx, user.ID)
+	} else if len(args) > 1 {
+		var stored database.Quota
+		stored, err = db.SelectQuota(ctx, user.ID)
+		if err == nil {
+			err = parseQuotaArgs(&stored, args[1:])
+		}
+		if err == nil {
+			err = db.InsertQuota(ctx, &stored)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	l, err := NewQuotas(db).Limits(ctx, user.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("rps=%g burst=%d pending=%d actions=%d\n", l.RPS, l.Burst, l.MaxPending, l.MaxActions)
+	return 0
+}
+
+func parseQuotaArgs(q *database.Quota, args []string) error {
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", arg)
+		}
+		if key == "rps" {
+			if value == "default" {
+				q.RPS = nil
+				continue
+			}
+			rps, err := strconv.ParseFloat(value, 64)
+			if err != nil || rps < 0 {
+				return fmt.Errorf("incorrect rps %q", value)
+			}
+			q.RPS = &rps
+			continue
+		}
+
+		var field **int
+		switch key {
+		case "burst":
+			field = &q.Burst
+		case "pending":
+			field = &q.MaxPending
+		case "actions":
+			field = &q.MaxActions
+		default:
+			return fmt.Errorf("unknown limit %q", key)
+		}
+		if value == "default" {
+			*field = nil
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("incorrect %s %q", key, value)
+		}
+		*field = &n
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+// RecoveryReport - что нашлось в базе при запуске после аварийной остановки
+type RecoveryReport struct {
+	Expressions int   // невычисленные выражения
+	Released    int64 // действия, выданные вычислителям до остановки и возвращённые в очередь
+	Completed   int   // выражения, все действия которых уже были посчитаны
+	Failed      int   // выражения без действий, которые никогда не досчитаются
+}
+
+func (r RecoveryReport) String() string {
+	return fmt.Sprintf("невычисленных выражений %d, возвращено в очередь действий %d, завершено выражений %d, с ошибкой %d",
+		r.Expressions, r.Released, r.Completed, r.Failed)
+}
+
+// Recover приводит невычисленные выражения в порядок после перезапуска. Вычислители, получившие
+// действия от прошлого процесса, ответа уже не ждут, поэтому такие действия выдаются заново.
+// Статус выражения пересчитывается по его действиям: остановка между последним SetResult
+// и обновлением выражения оставила бы его невычисленным навсегда.
+func (s *Server) Recover(ctx context.Context) (RecoveryReport, error) {
+	var report RecoveryReport
+
+	exprs, err := s.db.SelectExpressionsByStatus(ctx, "under consideration")
+	if err != nil {
+		return report, err
+	}
+	report.Expressions = len(exprs)
+
+	for _, expr := range exprs {
+		actions, err := s.db.SelectActions(ctx, expr.UserID, expr.ID)
+		if err != nil {
+			return report, err
+		}
+
+		if len(actions) == 0 {
+			now := time.Now()
+			status := calculation.ErrCalc.Error()
+			if err := s.db.UpdateExpression(ctx, expr.UserID, expr.ID, &database.Expression{Status: status, CompletedAt: &now}); err != nil {
+				return report, err
+			}
+			report.Failed++
+			s.finish(ctx, expr.UserID, expr.ID, Event{Type: EventExpressionFailed, Status: status})
+			continue
+		}
+
+		complete := 0
+		for _, a := range actions {
+			if a.Completed {
+				complete++
+			}
+		}
+		if complete == len(actions) {
+			now := time.Now()
+			result := actions[len(actions)-1].Result
+			err := s.db.UpdateExpression(ctx, expr.UserID, expr.ID, &database.Expression{Status: "completed", Result: result,
+				CompletedAt: &now, ComputeMs: computeMs(actions)})
+			if err != nil {
+				return report, err
+			}
+			report.Completed++
+			s.finish(ctx, expr.UserID, expr.ID, Event{Type: EventExpressionCompleted, Status: "completed", Result: result})
+			continue
+		}
+
+		n, err := s.db.ReleaseActions(ctx, expr.UserID, expr.ID)
+		if err != nil {
+			return report, err
+		}
+		report.Released += n
+	}
+
+	return report, nil
+}
+
+// finish оповещает о выражении, которое досчиталось при восстановлении
+func (s *Server) finish(ctx context.Context, userID, exprID int64, e Event) {
+	e.UserID, e.ExpressionID = userID, exprID
+	s.notify(userID, exprID)
+	s.webhooks.Enqueue(ctx, userID, exprID)
+	s.publish(e)
+}
@@ -0,0 +1,136 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+var errNoSource = errors.New("expression has no stored source")
+
+// ResponseCompare - повторный запуск рядом с исходным выражением
+type ResponseCompare struct {
+	Original       database.Expression `json:"original"`
+	Rerun          database.Expression `json:"rerun"`
+	SameStatus     bool                `json:"sameStatus"`
+	SameResult     bool                `json:"sameResult"`
+	ComputeMsDelta int64               `json:"computeMsDelta"`
+}
+
+// rerunExpression создаёт новое выражение по сохранённому графу действий исходного, поэтому
+// повтор считает то же самое, даже если функции пользователя с тех пор изменились. Выражение
+// без действий (посчитанное на сервере или с ошибкой разбора) разбирается заново из текста.
+// Кэш результатов повтор не использует: его смысл - посчитать выражение заново.
+func rerunExpression(ctx context.Context, db calcStore, sched *Scheduler, quotas *Quotas, userID int64, orig database.Expression) (database.Expression, error) {
+	actions, err := db.SelectActions(ctx, userID, orig.ID)
+	if err != nil {
+		return database.Expression{}, err
+	}
+	if len(actions) == 0 {
+		if orig.Expression == "" {
+			return database.Expression{}, errNoSource
+		}
+		return submitExpression(ctx, db, sched, quotas, nil, userID, RequestCalc{Expression: orig.Expression, Priority: orig.Priority, RerunOf: orig.ID})
+	}
+
+	vars, err := db.SelectVariables(ctx, userID, orig.ID)
+	if err != nil {
+		return database.Expression{}, err
+	}
+	expr := database.Expression{
+		Status:     "under consideration",
+		Expression: orig.Expression,
+		Priority:   orig.Priority,
+		RerunOf:    orig.ID,
+	}
+	for _, a := range actions {
+		expr.Actions = append(expr.Actions, database.Action{Arg1: a.Arg1, Arg2: a.Arg2, Operation: a.Operation, IdDepends: a.IdDepends})
+	}
+	for _, v := range vars {
+		v.Completed = false
+		if v.ActionID != -1 {
+			v.Value = 0
+		}
+		expr.Variables = append(expr.Variables, v)
+	}
+
+	var ids []int64
+	err = quotas.Submit(ctx, userID, []int{len(expr.Actions)}, func() (err error) {
+		ids, err = db.InsertExpressions(ctx, userID, []database.Expression{expr})
+		return err
+	})
+	if err != nil {
+		return database.Expression{}, err
+	}
+	sched.Add(userID, ids[0], expr)
+	return database.Expression{ID: ids[0]}, nil
+}
+
+func (h *ExpressionsIdHandler) serveRerun(w http.ResponseWriter, r *http.Request, orig database.Expression) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := h.quotas.allowRequest(r.Context(), userID); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	resp, err := rerunExpression(context.TODO(), h.db, h.scheduler, h.quotas, userID, orig)
+	switch {
+	case errors.Is(err, errNoSource):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	case errors.Is(err, errInvalidExpression):
+		status = http.StatusUnprocessableEntity
+	case err != nil:
+		writeLimitError(w, err)
+		return
+	}
+
+	if status == http.StatusCreated && resp.Status == "" && wait > 0 {
+		if e, err := waitExpression(r.Context(), h.db, h.notifier, userID, resp.ID, wait); err == nil {
+			resp.Status = e.Status
+			resp.Result = e.Result
+		}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(database.Expression{ID: resp.ID, Status: resp.Status, Result: resp.Result, RerunOf: orig.ID})
+}
+
+// serveCompare сравнивает повторный запуск с исходным выражением
+func (h *ExpressionsIdHandler) serveCompare(w http.ResponseWriter, rerun database.Expression) {
+	if rerun.RerunOf == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ResponseError{Message: "expression is not a rerun"})
+		return
+	}
+	orig, err := h.db.SelectExpression(context.TODO(), userID, rerun.RerunOf)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(orig) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ResponseError{Message: "original expression is deleted"})
+		return
+	}
+
+	resp := ResponseCompare{Original: orig[0], Rerun: rerun}
+	resp.SameStatus = resp.Original.Status == resp.Rerun.Status
+	resp.SameResult = resp.SameStatus && resp.Original.Result == resp.Rerun.Result
+	resp.ComputeMsDelta = resp.Rerun.ComputeMs - resp.Original.ComputeMs
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,473 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	defaultFlushInterval = 50 * time.Millisecond
+	flushBatchSize       = 256
+	// defaultClaimMargin - сколько сверх времени операции вычислитель может не отвечать,
+	// прежде чем действие выдадут заново
+	defaultClaimMargin = 30 * time.Second
+	claimCheckInterval = time.Second
+
+	maxPriority = 9
+	// strideScale делится на 1..maxPriority+1, поэтому шаг каждого приоритета целый
+	strideScale = 2520
+)
+
+var errIncorrectPriority = errors.New("incorrect priority")
+
+// validatePriority проверяет приоритет из запроса: от 0 (по умолчанию) до maxPriority
+func validatePriority(priority int) error {
+	if priority < 0 || priority > maxPriority {
+		return errIncorrectPriority
+	}
+	return nil
+}
+
+type actionKey struct {
+	exprKey
+	actionID int64
+}
+
+// schedExpr - невычисленное выражение в памяти планировщика
+type schedExpr struct {
+	actions    []database.Action
+	waiting    []int     // сколько зависимостей каждого действия ещё не посчитано
+	dependents [][]int64 // какие действия ждут результата каждого действия
+	completed  int
+	started    bool
+	priority   int
+	// rerun - повторный запуск: его действия всегда считают вычислители, а не кэш
+	rerun bool
+}
+
+// readyItem - готовое действие в очереди пользователя
+type readyItem struct {
+	actionKey
+	priority int
+	seq      uint64
+}
+
+// readyQueue - куча готовых действий пользователя: сначала больший приоритет, при равном - раньше добавленное
+type readyQueue []readyItem
+
+func (q readyQueue) Len() int { return len(q) }
+func (q readyQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q readyQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *readyQueue) Push(x any)   { *q = append(*q, x.(readyItem)) }
+func (q *readyQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// userQueue - готовые действия одного пользователя и его виртуальное время pass.
+// Каждая выданная задача сдвигает pass на strideScale / (приоритет + 1), а следующей
+// обслуживается очередь с наименьшим pass. Так пользователи получают задачи поровну,
+// а задачи с приоритетом p весят в p + 1 раз больше обычных.
+type userQueue struct {
+	ready readyQueue
+	pass  uint64
+}
+
+// Scheduler держит невычисленные выражения в памяти и раздаёт действия из очередей готовых,
+// не читая базу на каждый GetTask. Когда приходит результат, в очередь попадают действия,
+// у которых не осталось непосчитанных зависимостей. У каждого пользователя своя очередь,
+// между очередями задачи делятся справедливо с учётом приоритета (см. userQueue),
+// поэтому тысячи выражений одного пользователя не задерживают остальных.
+//
+// Изменения действий пишутся в базу не сразу, а пачками раз в SCHEDULER_FLUSH_MS (по умолчанию 50 мс)
+// или когда их накопится flushBatchSize. Перед записью завершённого выражения все накопленные
+// изменения сбрасываются, поэтому ожидающие результат видят в базе выражение целиком.
+// Если процесс упадёт до записи, Recover при следующем запуске выдаст потерянные действия заново.
+//
+// Выданное действие ждёт ответа время операции плюс TASK_TIMEOUT_MARGIN_MS (по умолчанию 30 с).
+// Если вычислитель за это время не ответил, действие возвращается в очередь готовых,
+// а его поздний ответ не принимается.
+type Scheduler struct {
+	db database.ExpressionStore
+
+	mu      sync.Mutex
+	exprs   map[exprKey]*schedExpr
+	users   map[int64]*userQueue
+	vtime   uint64 // pass последней обслуженной очереди
+	seq     uint64
+	dirty   map[actionKey]database.Action
+	started map[exprKey]time.Time
+	claims  map[actionKey]time.Time // до какого времени действие выдано вычислителю
+
+	claimMargin time.Duration
+
+	flushMu       sync.Mutex
+	flushInterval time.Duration
+	kick          chan struct{}
+}
+
+func NewScheduler(db database.ExpressionStore) *Scheduler {
+	interval := defaultFlushInterval
+	if ms, err := strconv.Atoi(os.Getenv("SCHEDULER_FLUSH_MS")); err == nil && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	margin := defaultClaimMargin
+	if ms, err := strconv.Atoi(os.Getenv("TASK_TIMEOUT_MARGIN_MS")); err == nil && ms > 0 {
+		margin = time.Duration(ms) * time.Millisecond
+	}
+	return &Scheduler{
+		db:            db,
+		exprs:         map[exprKey]*schedExpr{},
+		users:         map[int64]*userQueue{},
+		dirty:         map[actionKey]database.Action{},
+		started:       map[exprKey]time.Time{},
+		claims:        map[actionKey]time.Time{},
+		claimMargin:   margin,
+		flushInterval: interval,
+		kick:          make(chan struct{}, 1),
+	}
+}
+
+// Load загружает из базы все невычисленные выражения. Вызывается при запуске после Recover
+func (sc *Scheduler) Load(ctx context.Context) error {
+	exprs, err := sc.db.SelectExpressionsByStatus(ctx, "under consideration")
+	if err != nil {
+		return err
+	}
+	for _, expr := range exprs {
+		actions, err := sc.db.SelectActions(ctx, expr.UserID, expr.ID)
+		if err != nil {
+			return err
+		}
+		sc.addStored(expr, actions)
+	}
+	return nil
+}
+
+// addStored ставит в очередь выражение, прочитанное из базы вместе с действиями
+func (sc *Scheduler) addStored(expr database.Expression, actions []database.Action) {
+	if sc == nil {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.add(exprKey{expr.UserID, expr.ID}, expr.Priority, expr.RerunOf != 0, actions)
+}
+
+// Add ставит в очередь только что сохранённое выражение. Номера действий - их позиции, начиная с 1
+func (sc *Scheduler) Add(userID, exprID int64, expr database.Expression) {
+	if sc == nil || len(expr.Actions) == 0 {
+		return
+	}
+	actions := slices.Clone(expr.Actions)
+	for i := range actions {
+		actions[i].ID = int64(i + 1)
+		actions[i].ExpressionID = exprID
+		actions[i].UserID = userID
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.add(exprKey{userID, exprID}, expr.Priority, expr.RerunOf != 0, actions)
+}
+
+// cacheable сообщает, можно ли брать результаты действий выражения из кэша
+func (sc *Scheduler) cacheable(userID, exprID int64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e := sc.exprs[exprKey{userID, exprID}]
+	return e != nil && !e.rerun
+}
+
+func (sc *Scheduler) add(key exprKey, priority int, rerun bool, actions []database.Action) {
+	priority = min(max(priority, 0), maxPriority)
+	e := &schedExpr{
+		actions:    actions,
+		waiting:    make([]int, len(actions)),
+		dependents: make([][]int64, len(actions)),
+		priority:   priority,
+		rerun:      rerun,
+	}
+	for i := range actions {
+		a := &actions[i]
+		if a.Completed {
+			e.completed++
+			continue
+		}
+		// Ответа на действие, выданное до загрузки, никто не ждёт
+		a.NowCalculate = false
+		for _, dep := range a.IdDepends {
+			if dep == -1 {
+				continue
+			}
+			e.dependents[dep-1] = append(e.dependents[dep-1], a.ID)
+			if !actions[dep-1].Completed {
+				e.waiting[i]++
+			}
+		}
+	}
+	if e.completed == len(actions) {
+		return
+	}
+
+	sc.exprs[key] = e
+	for i, a := range actions {
+		if !a.Completed && e.waiting[i] == 0 {
+			sc.push(actionKey{key, a.ID}, priority)
+		}
+	}
+}
+
+func (sc *Scheduler) push(key actionKey, priority int) {
+	u := sc.users[key.userID]
+	if u == nil {
+		u = &userQueue{}
+		sc.users[key.userID] = u
+	}
+	// Простаивавшая очередь не копит право на внеочередную раздачу
+	if len(u.ready) == 0 {
+		u.pass = max(u.pass, sc.vtime)
+	}
+	sc.seq++
+	heap.Push(&u.ready, readyItem{actionKey: key, priority: priority, seq: sc.seq})
+}
+
+// pop берёт действие из очереди с наименьшим pass, при равном - пользователя с меньшим id.
+// Очередь сдвигается только за действительно выданное действие, см. charge
+func (sc *Scheduler) pop() (readyItem, *userQueue, bool) {
+	var next *userQueue
+	var nextID int64
+	for id, u := range sc.users {
+		if len(u.ready) == 0 {
+			delete(sc.users, id)
+			continue
+		}
+		if next == nil || u.pass < next.pass || u.pass == next.pass && id < nextID {
+			next, nextID = u, id
+		}
+	}
+	if next == nil {
+		return readyItem{}, nil, false
+	}
+	return heap.Pop(&next.ready).(readyItem), next, true
+}
+
+func (sc *Scheduler) charge(u *userQueue, priority int) {
+	sc.vtime = u.pass
+	u.pass += strideScale / uint64(priority+1)
+}
+
+// Next выдаёт вычислителю agent следующее готовое действие. Аргументы, которые
+// зависят от других действий, уже подставлены из их результатов.
+func (sc *Scheduler) Next(agent string, now time.Time) (database.Action, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		item, u, ok := sc.pop()
+		if !ok {
+			return database.Action{}, false
+		}
+		key := item.actionKey
+
+		e := sc.exprs[key.exprKey]
+		if e == nil {
+			continue
+		}
+		a := &e.actions[key.actionID-1]
+		if a.Completed || a.NowCalculate {
+			continue
+		}
+
+		sc.charge(u, item.priority)
+		a.NowCalculate, a.Agent, a.StartedAt = true, agent, &now
+		sc.markDirty(*a)
+		sc.claims[key] = now.Add(time.Duration(operationTime(a.Operation))*time.Millisecond + sc.claimMargin)
+		if !e.started {
+			e.started = true
+			sc.started[key.exprKey] = now
+		}
+
+		task := *a
+		if d := a.IdDepends[0]; d != -1 {
+			task.Arg1 = e.actions[d-1].Result
+		}
+		if d := a.IdDepends[1]; d != -1 {
+			task.Arg2 = e.actions[d-1].Result
+		}
+		return task, true
+	}
+}
+
+// Complete принимает результат действия от вычислителя agent. ok равен false, если такого
+// действия нет или оно сейчас не выдано agent: не выдавалось, уже посчитано или после
+// истечения срока выдано другому.
+// Если выражение на этом закончилось, возвращается его итог (без сохранения) и все его действия.
+func (sc *Scheduler) Complete(userID, exprID, actionID int64, agent string, result float64, failed bool, now time.Time) (finished *database.Expression, actions []database.Action, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	key := exprKey{userID, exprID}
+	e := sc.exprs[key]
+	if e == nil || actionID < 1 || actionID > int64(len(e.actions)) {
+		return nil, nil, false
+	}
+	a := &e.actions[actionID-1]
+	if a.Completed || !a.NowCalculate || a.Agent != agent {
+		return nil, nil, false
+	}
+	delete(sc.claims, actionKey{key, actionID})
+	a.FinishedAt = &now
+
+	if failed {
+		sc.markDirty(*a)
+		delete(sc.exprs, key)
+		return &database.Expression{Status: "division by zero", CompletedAt: &now}, slices.Clone(e.actions), true
+	}
+
+	a.Result, a.Completed, a.NowCalculate = result, true, false
+	sc.markDirty(*a)
+	e.completed++
+	for _, id := range e.dependents[actionID-1] {
+		e.waiting[id-1]--
+		if e.waiting[id-1] == 0 {
+			sc.push(actionKey{key, id}, e.priority)
+		}
+	}
+
+	if e.completed < len(e.actions) {
+		return nil, nil, true
+	}
+	delete(sc.exprs, key)
+	root := e.actions[len(e.actions)-1]
+	return &database.Expression{Status: "completed", Result: root.Result, CompletedAt: &now}, slices.Clone(e.actions), true
+}
+
+// Expire возвращает в очередь готовых действия, ответа на которые не было к now,
+// и возвращает их количество
+func (sc *Scheduler) Expire(now time.Time) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	n := 0
+	for key, deadline := range sc.claims {
+		if now.Before(deadline) {
+			continue
+		}
+		delete(sc.claims, key)
+		e := sc.exprs[key.exprKey]
+		if e == nil {
+			continue
+		}
+		a := &e.actions[key.actionID-1]
+		if a.Completed || !a.NowCalculate {
+			continue
+		}
+		a.NowCalculate, a.Agent, a.StartedAt = false, "", nil
+		sc.markDirty(*a)
+		sc.push(key, e.priority)
+		n++
+	}
+	return n
+}
+
+func (sc *Scheduler) markDirty(a database.Action) {
+	sc.dirty[actionKey{exprKey{a.UserID, a.ExpressionID}, a.ID}] = a
+	if len(sc.dirty) >= flushBatchSize {
+		select {
+		case sc.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run сбрасывает изменения в базу и возвращает в очередь просроченные действия, пока не
+// отменён ctx, и делает последний сброс перед выходом
+func (sc *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sc.flushInterval)
+	defer ticker.Stop()
+	expire := time.NewTicker(claimCheckInterval)
+	defer expire.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := sc.Flush(context.Background()); err != nil {
+				log.Printf("scheduler flush: %v", err)
+			}
+			return
+		case <-ticker.C:
+		case <-sc.kick:
+		case now := <-expire.C:
+			if n := sc.Expire(now); n > 0 {
+				log.Printf("scheduler: %d tasks were not answered in time and are queued again", n)
+			}
+		}
+		if err := sc.Flush(ctx); err != nil {
+			log.Printf("scheduler flush: %v", err)
+		}
+	}
+}
+
+// Flush записывает накопленные изменения одной пачкой. При ошибке они остаются в очереди на запись,
+// если их не успели заменить более новые.
+func (sc *Scheduler) Flush(ctx context.Context) error {
+	// Сбросы идут по очереди, иначе старая пачка могла бы записаться поверх новой
+	sc.flushMu.Lock()
+	defer sc.flushMu.Unlock()
+
+	sc.mu.Lock()
+	dirty, started := sc.dirty, sc.started
+	sc.dirty, sc.started = map[actionKey]database.Action{}, map[exprKey]time.Time{}
+	sc.mu.Unlock()
+
+	err := sc.write(ctx, dirty, started)
+	if err != nil {
+		sc.mu.Lock()
+		for k, a := range dirty {
+			if _, newer := sc.dirty[k]; !newer {
+				sc.dirty[k] = a
+			}
+		}
+		for k, t := range started {
+			if _, newer := sc.started[k]; !newer {
+				sc.started[k] = t
+			}
+		}
+		sc.mu.Unlock()
+	}
+	return err
+}
+
+func (sc *Scheduler) write(ctx context.Context, dirty map[actionKey]database.Action, started map[exprKey]time.Time) error {
+	if len(dirty) > 0 {
+		actions := make([]database.Action, 0, len(dirty))
+		for _, a := range dirty {
+			actions = append(actions, a)
+		}
+		if err := sc.db.UpdateActions(ctx, actions); err != nil {
+			return err
+		}
+	}
+	for k, t := range started {
+		if err := sc.db.UpdateExpressionStarted(ctx, k.userID, k.exprID, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
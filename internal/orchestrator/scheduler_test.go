@@ -0,0 +1,659 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+	pb "github.com/hidnt/lms_yandex_final/proto"
+)
+
+// drain раздаёт и считает задачи, пока они не кончатся, и возвращает их количество
+func drain(t testing.TB, server *Server) int {
+	n := 0
+	for {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			return n
+		}
+		completeTask(t, server, task)
+		n++
+	}
+}
+
+func submit(t testing.TB, h *CalcHandler, expressions ...string) {
+	for _, expression := range expressions {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Unexpected status code after correct expression %q: %v", expression, rec.Code)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "scheduler")
+
+	scheduler := NewScheduler(db)
+	server := &Server{db: db, scheduler: scheduler}
+	submit(t, &CalcHandler{db: db, scheduler: scheduler}, "2+2*3", "(1+2)*(3+4)", "5/0")
+
+	// Результат известен только после ответа на первое действие, второе ещё не готово
+	task, err := server.GetTask(context.Background(), &pb.Empty{})
+	if err != nil || task.ExpressionId != 1 || task.Operation != "*" {
+		t.Fatalf("Unexpected first task: %+v %v", task, err)
+	}
+	completeTask(t, server, task)
+	if n := drain(t, server); n != 5 {
+		t.Fatalf("want 5 more tasks, have %d", n)
+	}
+
+	for _, want := range []database.Expression{
+		{ID: 1, Status: "completed", Result: 8},
+		{ID: 2, Status: "completed", Result: 21},
+		{ID: 3, Status: "division by zero"},
+	} {
+		exprs, _ := db.SelectExpression(context.Background(), userID, want.ID)
+		e := exprs[0]
+		if e.Status != want.Status || e.Result != want.Result || e.StartedAt == nil || e.CompletedAt == nil {
+			t.Errorf("Unexpected expression %d: %+v", want.ID, e)
+		}
+	}
+
+	// Действия законченного выражения записаны в базу до самого выражения
+	actions, _ := db.SelectActions(context.Background(), userID, 2)
+	for _, a := range actions {
+		if !a.Completed || a.NowCalculate || a.StartedAt == nil || a.FinishedAt == nil {
+			t.Errorf("Unexpected persisted action: %+v", a)
+		}
+	}
+
+	if _, err := server.SetResult(context.Background(), &pb.TaskResponse{ID: 1, ExpressionId: 1, UserID: userID, Res: 1}); err == nil {
+		t.Errorf("Result for completed expression is accepted")
+	}
+
+	calc := &CalcHandler{db: db, scheduler: scheduler}
+	rec := httptest.NewRecorder()
+	calc.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1+1", "priority": 10}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code for incorrect priority: %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	calc.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1+1", "priority": 7}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code for priority: %v", rec.Code)
+	}
+	if exprs, _ := db.SelectExpression(context.Background(), userID, 4); exprs[0].Priority != 7 {
+		t.Errorf("Priority is not stored: %+v", exprs[0])
+	}
+}
+
+func TestSchedulerComplete(t *testing.T) {
+	sc := NewScheduler(nil)
+	sc.Add(1, 1, database.Expression{Actions: []database.Action{
+		{Arg1: 1, Arg2: 0, Operation: "/", IdDepends: []int64{-1, -1}},
+		{Arg1: 2, Arg2: 3, Operation: "+", IdDepends: []int64{-1, -1}},
+	}})
+
+	// Ошибка по невыданному действию не удаляет выражение
+	if _, _, ok := sc.Complete(1, 1, 2, "agent-1", 0, true, time.Now()); ok {
+		t.Fatalf("Result for an unclaimed action is accepted")
+	}
+	task, ok := sc.Next("agent-1", time.Now())
+	if !ok || task.ID != 1 {
+		t.Fatalf("Unexpected task: %+v %v", task, ok)
+	}
+	if _, _, ok := sc.Complete(1, 1, 1, "agent-2", 0, true, time.Now()); ok {
+		t.Fatalf("Result from another agent is accepted")
+	}
+	if _, _, ok := sc.Complete(1, 1, 1, "agent-1", 0, true, time.Now()); !ok {
+		t.Fatalf("Result from the claiming agent is rejected")
+	}
+}
+
+func TestSchedulerClaimTimeout(t *testing.T) {
+	t.Setenv("TIME_ADDITION_MS", "100")
+	sc := NewScheduler(nil)
+	sc.claimMargin = time.Second
+	sc.Add(1, 1, database.Expression{Actions: []database.Action{
+		{Arg1: 2, Arg2: 3, Operation: "+", IdDepends: []int64{-1, -1}},
+	}})
+
+	start := time.Now()
+	if _, ok := sc.Next("agent-1", start); !ok {
+		t.Fatalf("No task")
+	}
+	if _, ok := sc.Next("agent-2", start); ok {
+		t.Fatalf("Claimed task is given twice")
+	}
+
+	// Пока не прошло время операции и запас, действие остаётся за первым вычислителем
+	if n := sc.Expire(start.Add(time.Second)); n != 0 {
+		t.Fatalf("Task expired too early: %d", n)
+	}
+	if n := sc.Expire(start.Add(1100 * time.Millisecond)); n != 1 {
+		t.Fatalf("want 1 expired task, have %d", n)
+	}
+	task, ok := sc.Next("agent-2", start.Add(2*time.Second))
+	if !ok || task.ID != 1 || task.Agent != "agent-2" {
+		t.Fatalf("Expired task is not given again: %+v %v", task, ok)
+	}
+
+	// Опоздавший ответ первого вычислителя не принимается
+	if _, _, ok := sc.Complete(1, 1, 1, "agent-1", 5, false, time.Now()); ok {
+		t.Fatalf("Late result is accepted")
+	}
+	finished, _, ok := sc.Complete(1, 1, 1, "agent-2", 5, false, time.Now())
+	if !ok || finished == nil || finished.Result != 5 {
+		t.Fatalf("Unexpected result: %+v %v", finished, ok)
+	}
+}
+
+func TestSchedulerLoad(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "load")
+
+	// Выражения добавлены прошлым процессом, одно действие выдано и потеряно
+	submit(t, &CalcHandler{db: db}, "2+2*3", "1-1")
+	if _, err := (&Server{db: db}).GetTask(context.Background(), &pb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(db)
+	server := &Server{db: db, scheduler: scheduler}
+	if _, err := server.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := drain(t, server); n != 3 {
+		t.Fatalf("want 3 tasks, have %d", n)
+	}
+	exprs, _ := db.SelectExpression(context.Background(), userID, 1)
+	if exprs[0].Status != "completed" || exprs[0].Result != 8 {
+		t.Fatalf("Unexpected expression: %+v", exprs[0])
+	}
+}
+
+// BenchmarkDispatch сравнивает раздачу задач из базы и через Scheduler на SQLite.
+// Одна операция - GetTask и SetResult одного действия при backlog невычисленных выражений.
+func BenchmarkDispatch(b *testing.B) {
+	for _, backlog := range []int{10, 100} {
+		for _, scheduled := range []bool{false, true} {
+			name := "db"
+			if scheduled {
+				name = "scheduler"
+			}
+			b.Run(fmt.Sprintf("%s/backlog=%d", name, backlog), func(b *testing.B) {
+				benchmarkDispatch(b, backlog, scheduled)
+			})
+		}
+	}
+}
+
+func benchmarkDispatch(b *testing.B, backlog int, scheduled bool) {
+	db, err := database.OpenSQLite(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Migrate(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	loginAs(b, db, "bench")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	server := &Server{db: db}
+	calc := &CalcHandler{db: db}
+	if scheduled {
+		server.scheduler = NewScheduler(db)
+		calc.scheduler = server.scheduler
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			server.scheduler.Run(ctx)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	refill := func() {
+		for range backlog {
+			submit(b, calc, "1+2*3")
+		}
+	}
+	refill()
+
+	b.ResetTimer()
+	for range b.N {
+		task, err := server.GetTask(context.Background(), &pb.Empty{})
+		if err != nil {
+			b.StopTimer()
+			refill()
+			b.StartTimer()
+			if task, err = server.GetTask(context.Background(), &pb.Empty{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		completeTask(b, server, task)
+	}
+}
+
+// TestSchedulerFairness моделирует раздачу задач нескольким пользователям без базы и вычислителей
+func TestScheduledExpressions(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "delayed")
+
+	scheduler := NewScheduler(db)
+	promoter := NewPromoter(db, scheduler, nil)
+	server := &Server{db: db, scheduler: scheduler}
+	calc := &CalcHandler{db: db, scheduler: scheduler, promoter: promoter}
+
+	post := func(body string) (*httptest.ResponseRecorder, database.Expression) {
+		rec := httptest.NewRecorder()
+		calc.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+		var resp database.Expression
+		json.NewDecoder(bytes.NewReader(rec.Body.Bytes())).Decode(&resp)
+		return rec, resp
+	}
+
+	for _, body := range []string{
+		`{"expression": "1+1", "delay": "1h", "run_at": "2030-01-01T00:00:00Z"}`,
+		`{"expression": "1+1", "delay": "soon"}`,
+		`{"expression": "1+1", "delay": "-1m"}`,
+	} {
+		if rec, _ := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status code for %s: %v", body, rec.Code)
+		}
+	}
+
+	start := time.Now()
+	rec, resp := post(`{"expression": "2+2*3", "delay": "1h"}`)
+	if rec.Code != http.StatusCreated || resp.RunAt == nil || resp.RunAt.Sub(start) < time.Hour {
+		t.Fatalf("Unexpected response for delayed expression: %v %+v", rec.Code, resp)
+	}
+	// Время в прошлом - запуск сразу
+	if rec, resp := post(`{"expression": "1+1", "run_at": "2001-01-01T00:00:00Z"}`); rec.Code != http.StatusCreated || resp.RunAt != nil {
+		t.Fatalf("Unexpected response for past run_at: %v %+v", rec.Code, resp)
+	}
+
+	exprs, _ := db.SelectExpression(context.Background(), userID, 1)
+	if exprs[0].Status != "scheduled" || exprs[0].RunAt == nil {
+		t.Fatalf("Unexpected stored delayed expression: %+v", exprs[0])
+	}
+	if n := drain(t, server); n != 1 {
+		t.Fatalf("Delayed expression is handed out: %d tasks", n)
+	}
+
+	next, err := promoter.Promote(context.Background(), time.Now())
+	if err != nil || next == nil || !next.Equal(*exprs[0].RunAt) {
+		t.Fatalf("Unexpected next run: %v %v", next, err)
+	}
+	if next, err := promoter.Promote(context.Background(), exprs[0].RunAt.Add(time.Millisecond)); err != nil || next != nil {
+		t.Fatalf("Unexpected next run after promotion: %v %v", next, err)
+	}
+	if n := drain(t, server); n != 2 {
+		t.Fatalf("want 2 tasks of released expression, have %d", n)
+	}
+	exprs, _ = db.SelectExpression(context.Background(), userID, 1)
+	if exprs[0].Status != "completed" || exprs[0].Result != 8 {
+		t.Fatalf("Unexpected released expression: %+v", exprs[0])
+	}
+
+	// После перезапуска таймер выпускает выражение, отложенное прошлым процессом
+	_, resp = post(`{"expression": "3*3", "delay": "30ms"}`)
+	scheduler = NewScheduler(db)
+	server = &Server{db: db, scheduler: scheduler}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewPromoter(db, scheduler, nil).Run(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for drain(t, server) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Delayed expression is not released after restart")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	exprs, _ = db.SelectExpression(context.Background(), userID, resp.ID)
+	if exprs[0].Status != "completed" || exprs[0].Result != 9 {
+		t.Fatalf("Unexpected expression released after restart: %+v", exprs[0])
+	}
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	addN := func(sc *Scheduler, userID int64, n, priority int) {
+		first := int64(len(sc.exprs)) + 1
+		for i := range int64(n) {
+			sc.Add(userID, first+i, database.Expression{Priority: priority, Actions: []database.Action{
+				{Arg1: 1, Arg2: 1, Operation: "+", IdDepends: []int64{-1, -1}},
+			}})
+		}
+	}
+	// dispatch раздаёт и сразу завершает n задач и возвращает, чьи они были
+	dispatch := func(sc *Scheduler, n int) []int64 {
+		var users []int64
+		for range n {
+			a, ok := sc.Next("agent", time.Now())
+			if !ok {
+				break
+			}
+			sc.Complete(a.UserID, a.ExpressionID, a.ID, "agent", 2, false, time.Now())
+			users = append(users, a.UserID)
+		}
+		return users
+	}
+	positions := func(users []int64, userID int64) []int {
+		var pos []int
+		for i, u := range users {
+			if u == userID {
+				pos = append(pos, i)
+			}
+		}
+		return pos
+	}
+
+	t.Run("no starvation", func(t *testing.T) {
+		sc := NewScheduler(database.NewMemoryStore())
+		addN(sc, 1, 10000, 0)
+		addN(sc, 2, 10, 0)
+
+		// При равных весах k-я задача второго пользователя выдаётся не позже 2k-й по счёту
+		for k, pos := range positions(dispatch(sc, 100), 2) {
+			if pos > 2*(k+1) {
+				t.Fatalf("task %d of the small user dispatched at %d", k+1, pos)
+			}
+		}
+	})
+
+	t.Run("late arrival", func(t *testing.T) {
+		sc := NewScheduler(database.NewMemoryStore())
+		addN(sc, 1, 10000, 0)
+		dispatch(sc, 5000)
+
+		// Пользователь, пришедший позже, не ждёт, пока раздадутся накопленные задачи первого,
+		// но и не получает все задачи подряд за время простоя
+		addN(sc, 2, 10, 0)
+		users := dispatch(sc, 20)
+		if pos := positions(users, 2); len(pos) != 10 {
+			t.Fatalf("late user got %d of first 20 tasks: %v", len(pos), users)
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		sc := NewScheduler(database.NewMemoryStore())
+		addN(sc, 1, 1000, 0)
+		addN(sc, 2, 1000, 3)
+
+		// Задача с приоритетом 3 весит как четыре обычных: второй пользователь получает 4/5 задач
+		n := len(positions(dispatch(sc, 500), 2))
+		if n < 395 || n > 405 {
+			t.Fatalf("weighted user got %d of 500 tasks, want about 400", n)
+		}
+	})
+
+	t.Run("priority within user", func(t *testing.T) {
+		sc := NewScheduler(database.NewMemoryStore())
+		addN(sc, 1, 5, 0)
+		addN(sc, 1, 5, 9)
+		for i := range 10 {
+			a, _ := sc.Next("agent", time.Now())
+			if high := a.ExpressionID > 5; high != (i < 5) {
+				t.Fatalf("task %d is expression %d", i, a.ExpressionID)
+			}
+		}
+	})
+}
+
+func TestSchedules(t *testing.T) {
+	db, cleanup := initDB(t)
+	defer cleanup()
+	owner := loginAs(t, db, "cron")
+
+	scheduler := NewScheduler(db)
+	runner := NewScheduleRunner(db, scheduler, nil, nil)
+	server := &Server{db: db, scheduler: scheduler}
+	h := &SchedulesHandler{db: db, runner: runner}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rec
+	}
+
+	for body, code := range map[string]int{
+		`{"expression": "1+1", "cron": "every minute"}`:              http.StatusBadRequest,
+		`{"expression": "1+1", "cron": "* * * * *", "keep": -1}`:     http.StatusBadRequest,
+		`{"expression": "1+1", "cron": "* * * * *", "priority": 99}`: http.StatusBadRequest,
+		`{"expression": "1+", "cron": "* * * * *"}`:                  http.StatusUnprocessableEntity,
+	} {
+		if rec := do("POST", "/api/v1/schedules", body); rec.Code != code {
+			t.Errorf("Unexpected status code for %s: %v", body, rec.Code)
+		}
+	}
+
+	rec := do("POST", "/api/v1/schedules", `{"expression": "2*3", "cron": "@every 1h", "keep": 2}`)
+	var sc database.Schedule
+	json.NewDecoder(rec.Body).Decode(&sc)
+	if rec.Code != http.StatusCreated || sc.ID == 0 || sc.NextRunAt == nil || sc.Keep != 2 {
+		t.Fatalf("Unexpected response for new schedule: %v %+v", rec.Code, sc)
+	}
+
+	// Раньше времени запуска выражения не создаются
+	next, err := runner.Fire(context.Background(), time.Now())
+	if err != nil || next == nil || !next.Equal(*sc.NextRunAt) {
+		t.Fatalf("Unexpected next run: %v %v", next, err)
+	}
+
+	at := *sc.NextRunAt
+	for i := range 3 {
+		next, err := runner.Fire(context.Background(), at)
+		if err != nil || next == nil || !next.Equal(at.Add(time.Hour)) {
+			t.Fatalf("Unexpected next run after firing %d: %v %v", i, next, err)
+		}
+		// Повторный вызов на то же время не создаёт второй запуск
+		runner.Fire(context.Background(), at)
+		if n := drain(t, server); n != 1 {
+			t.Fatalf("want 1 task of run %d, have %d", i, n)
+		}
+		at = *next
+	}
+	runner.Fire(context.Background(), at)
+
+	// Хранятся последние keep запусков
+	rec = do("GET", fmt.Sprintf("/api/v1/schedules/%d/runs", sc.ID), "")
+	var runs ResponseExpressions
+	json.NewDecoder(rec.Body).Decode(&runs)
+	if rec.Code != http.StatusOK || runs.Total != 2 {
+		t.Fatalf("Unexpected runs: %v %+v", rec.Code, runs)
+	}
+	for _, e := range runs.Expressions {
+		if e.ScheduleID != sc.ID || e.Expression != "2*3" {
+			t.Fatalf("Unexpected run: %+v", e)
+		}
+	}
+	if exprs, _ := db.SelectExpressions(context.Background(), userID); len(exprs) != 2 {
+		t.Fatalf("Old runs are not deleted: %d expressions", len(exprs))
+	}
+	drain(t, server)
+
+	// Запуск, не прошедший лимит, виден в /runs с ошибкой
+	t.Setenv("QUOTA_MAX_PENDING", "1")
+	runner.quotas = NewQuotas(db)
+	db.InsertExpressions(context.Background(), userID, []database.Expression{{Expression: "x", Status: "under consideration", Actions: []database.Action{{Operation: "+", IdDepends: []int64{-1, -1}}}}})
+	at = at.Add(time.Hour)
+	next, err = runner.Fire(context.Background(), at)
+	if err != nil || next == nil || !next.Equal(at.Add(time.Hour)) {
+		t.Fatalf("Unexpected next run after rejected run: %v %v", next, err)
+	}
+	runner.quotas = nil
+	rec = do("GET", fmt.Sprintf("/api/v1/schedules/%d/runs", sc.ID), "")
+	runs = ResponseExpressions{}
+	json.NewDecoder(rec.Body).Decode(&runs)
+	if n := len(runs.Expressions); n == 0 || !strings.Contains(runs.Expressions[n-1].Status, "too many pending") || runs.Expressions[n-1].CompletedAt == nil {
+		t.Fatalf("Rejected run is not recorded: %+v", runs)
+	}
+
+	rec = do("POST", fmt.Sprintf("/api/v1/schedules/%d/pause", sc.ID), "")
+	sc = database.Schedule{}
+	json.NewDecoder(rec.Body).Decode(&sc)
+	if rec.Code != http.StatusOK || !sc.Paused || sc.NextRunAt != nil {
+		t.Fatalf("Unexpected paused schedule: %v %+v", rec.Code, sc)
+	}
+	if next, err := runner.Fire(context.Background(), at.Add(24*time.Hour)); err != nil || next != nil {
+		t.Fatalf("Paused schedule is run: %v %v", next, err)
+	}
+
+	start := time.Now()
+	rec = do("POST", fmt.Sprintf("/api/v1/schedules/%d/resume", sc.ID), "")
+	json.NewDecoder(rec.Body).Decode(&sc)
+	if rec.Code != http.StatusOK || sc.Paused || sc.NextRunAt == nil || sc.NextRunAt.Before(start.Add(time.Hour-time.Second)) {
+		t.Fatalf("Unexpected resumed schedule: %v %+v", rec.Code, sc)
+	}
+
+	// Чужие расписания не видны
+	loginAs(t, db, "other")
+	if rec := do("GET", fmt.Sprintf("/api/v1/schedules/%d", sc.ID), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Unexpected status code for schedule of other user: %v", rec.Code)
+	}
+	if rec := do("GET", "/api/v1/schedules", ""); rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+		t.Fatalf("Unexpected schedules of other user: %v %s", rec.Code, rec.Body)
+	}
+	userID = owner
+
+	if rec := do("DELETE", fmt.Sprintf("/api/v1/schedules/%d", sc.ID), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code after delete: %v", rec.Code)
+	}
+	if rec := do("GET", fmt.Sprintf("/api/v1/schedules/%d", sc.ID), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Unexpected status code for deleted schedule: %v", rec.Code)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	if NewResultCache(0, time.Hour) != nil {
+		t.Fatalf("Cache with zero size is enabled")
+	}
+	var disabled *ResultCache
+	disabled.Put(calculation.ActionKey("+", 1, 1), 2, time.Now())
+	if _, ok := disabled.Get(1, calculation.ActionKey("+", 1, 1), time.Now()); ok || disabled.Stats(1).Enabled {
+		t.Fatalf("Disabled cache returns results")
+	}
+
+	now := time.Now()
+	lru := NewResultCache(2, time.Minute)
+	k1, k2, k3 := calculation.ActionKey("+", 1, 1), calculation.ActionKey("+", 1, 2), calculation.ActionKey("+", 1, 3)
+	lru.Put(k1, 2, now)
+	lru.Put(k2, 3, now)
+	lru.Get(1, k1, now)
+	lru.Put(k3, 4, now)
+	if _, ok := lru.Get(1, k2, now); ok {
+		t.Errorf("Least recently used entry is not evicted")
+	}
+	if v, ok := lru.Get(2, k1, now); !ok || v != 2 {
+		t.Errorf("Unexpected cached value: %v %v", v, ok)
+	}
+	if _, ok := lru.Get(2, k3, now.Add(time.Minute)); ok {
+		t.Errorf("Expired entry is returned")
+	}
+	// Попадания и промахи считаются для каждого пользователя отдельно
+	if s := lru.Stats(1); s.MaxEntries != 2 || s.Hits != 1 || s.Misses != 1 || s.TTL != "1m0s" {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if s := lru.Stats(2); s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("Unexpected stats of second user: %+v", s)
+	}
+	if s := lru.Stats(3); !s.Enabled || s.Hits != 0 || s.Misses != 0 {
+		t.Errorf("Unexpected stats of user without lookups: %+v", s)
+	}
+
+	db, cleanup := initDB(t)
+	defer cleanup()
+	loginAs(t, db, "cached")
+
+	cache := NewResultCache(100, time.Hour)
+	scheduler := NewScheduler(db)
+	server := &Server{db: db, scheduler: scheduler, cache: cache}
+	calc := &CalcHandler{db: db, scheduler: scheduler, cache: cache}
+	post := func(expression string) database.Expression {
+		rec := httptest.NewRecorder()
+		calc.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		var resp database.Expression
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Unexpected status code for %q: %v", expression, rec.Code)
+		}
+		return resp
+	}
+
+	post("2*3+1")
+	if n := drain(t, server); n != 2 {
+		t.Fatalf("want 2 tasks, have %d", n)
+	}
+
+	// Та же формула в другой записи считается сразу
+	if resp := post("1+3*2"); resp.Status != "completed" || resp.Result != 7 {
+		t.Fatalf("Cached expression is not completed: %+v", resp)
+	}
+	resp := post("a = 3*2; a+1")
+	vars, _ := db.SelectVariables(context.Background(), userID, resp.ID)
+	if resp.Status != "completed" || resp.Result != 7 || len(vars) != 1 || vars[0].Value != 6 {
+		t.Fatalf("Cached script is not completed: %+v %+v", resp, vars)
+	}
+
+	// Известное поддерево вычислителю не отдаётся
+	resp = post("2*3+5")
+	if n := drain(t, server); n != 1 {
+		t.Fatalf("want 1 task of partially cached expression, have %d", n)
+	}
+	exprs, _ := db.SelectExpression(context.Background(), userID, resp.ID)
+	if exprs[0].Status != "completed" || exprs[0].Result != 11 {
+		t.Fatalf("Unexpected partially cached expression: %+v", exprs[0])
+	}
+
+	// Повторный запуск считается заново
+	idHandler := &ExpressionsIdHandler{db: db, scheduler: scheduler}
+	rec := httptest.NewRecorder()
+	idHandler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/expressions/1/rerun", nil))
+	if n := drain(t, server); rec.Code != http.StatusCreated || n != 2 {
+		t.Fatalf("Rerun uses cache: %v, %d tasks", rec.Code, n)
+	}
+
+	rec = httptest.NewRecorder()
+	(&CacheHandler{cache: cache}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/cache", nil))
+	var stats CacheStats
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if !stats.Enabled || stats.Hits != 3 || stats.Misses < 2 {
+		t.Fatalf("Unexpected cache stats: %+v", stats)
+	}
+
+	// Другой пользователь не видит чужих попаданий
+	loginAs(t, db, "other cached")
+	rec = httptest.NewRecorder()
+	(&CacheHandler{cache: cache}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/cache", nil))
+	stats = CacheStats{}
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if !stats.Enabled || stats.Hits != 0 || stats.Misses != 0 || strings.Contains(rec.Body.String(), "entries") {
+		t.Fatalf("Unexpected cache stats of other user: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,323 @@
+package orchestrator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/calculation"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	defaultScheduleKeep = 100
+	maxScheduleKeep     = 1000
+)
+
+var (
+	errIncorrectCron = errors.New("incorrect cron")
+	errIncorrectKeep = errors.New("incorrect keep")
+)
+
+type RequestSchedule struct {
+	Expression string `json:"expression"`
+	Cron       string `json:"cron"`
+	Priority   int    `json:"priority,omitempty"`
+	// Keep - сколько последних посчитанных запусков хранить, по умолчанию SCHEDULE_KEEP_RUNS
+	Keep int `json:"keep,omitempty"`
+}
+
+func scheduleKeep() int {
+	n, err := strconv.Atoi(os.Getenv("SCHEDULE_KEEP_RUNS"))
+	if err != nil || n <= 0 || n > maxScheduleKeep {
+		return defaultScheduleKeep
+	}
+	return n
+}
+
+// parseCron разбирает расписание из пяти полей (минута, час, день, месяц, день недели),
+// дескрипторы вида @hourly, @every 1h30m и префикс CRON_TZ=
+func parseCron(spec string) (cron.Schedule, error) {
+	s, err := cron.ParseStandard(spec)
+	if err != nil || s.Next(time.Now()).IsZero() {
+		return nil, errIncorrectCron
+	}
+	return s, nil
+}
+
+// nextRun возвращает время следующего запуска расписания после now
+func nextRun(sc database.Schedule, now time.Time) (*time.Time, error) {
+	s, err := parseCron(sc.Cron)
+	if err != nil {
+		return nil, err
+	}
+	next := s.Next(now)
+	return &next, nil
+}
+
+// scheduleStore - расписания и выражения их запусков
+type scheduleStore interface {
+	calcStore
+	database.ScheduleStore
+}
+
+type SchedulesHandler struct {
+	db     scheduleStore
+	runner *ScheduleRunner
+}
+
+func (h *SchedulesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/schedules"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.list(w)
+		case http.MethodPost:
+			h.create(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, sub, _ := strings.Cut(rest, "/")
+	n, err := strconv.ParseInt(strings.TrimPrefix(id, ":"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sc, err := h.db.SelectSchedule(context.TODO(), userID, n)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(sc)
+	case sub == "" && r.Method == http.MethodDelete:
+		h.delete(w, sc)
+	case sub == "pause" && r.Method == http.MethodPost:
+		h.setPaused(w, sc, true)
+	case sub == "resume" && r.Method == http.MethodPost:
+		h.setPaused(w, sc, false)
+	case sub == "runs" && r.Method == http.MethodGet:
+		f, err := parseExpressionFilter(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+			return
+		}
+		f.ScheduleID = sc.ID
+		writeExpressionsPage(w, h.db, f)
+	case sub == "" || sub == "pause" || sub == "resume" || sub == "runs":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *SchedulesHandler) list(w http.ResponseWriter) {
+	schedules, err := h.db.SelectSchedules(context.TODO(), userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if schedules == nil {
+		schedules = []database.Schedule{}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func (h *SchedulesHandler) create(w http.ResponseWriter, r *http.Request) {
+	request := new(RequestSchedule)
+	defer r.Body.Close()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	now := time.Now()
+	sc := database.Schedule{UserID: userID, Expression: request.Expression, Cron: request.Cron,
+		Priority: request.Priority, Keep: request.Keep, CreatedAt: now}
+	if sc.Keep == 0 {
+		sc.Keep = scheduleKeep()
+	}
+	next, err := nextRun(sc, now)
+	if err == nil {
+		err = validatePriority(sc.Priority)
+	}
+	if err == nil && (sc.Keep < 0 || sc.Keep > maxScheduleKeep) {
+		err = errIncorrectKeep
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+	sc.NextRunAt = next
+
+	// Выражение проверяется сразу, чтобы не копить запуски с ошибкой. Длина и число
+	// токенов - ещё до обращения к базе
+	if err := calculation.CheckInput(request.Expression); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+	funcs, err := h.db.SelectFunctions(context.TODO(), userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := buildExpression(request.Expression, funcs); limitCode(err) != "" {
+		writeLimitError(w, err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ResponseError{Message: err.Error()})
+		return
+	}
+
+	sc.ID, err = h.db.InsertSchedule(context.TODO(), &sc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.runner.Wake()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sc)
+}
+
+func (h *SchedulesHandler) delete(w http.ResponseWriter, sc database.Schedule) {
+	if _, err := h.db.DeleteSchedule(context.TODO(), userID, sc.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPaused приостанавливает расписание или возобновляет его со следующего времени
+// после текущего: пропущенные за паузу запуски не догоняются
+func (h *SchedulesHandler) setPaused(w http.ResponseWriter, sc database.Schedule, paused bool) {
+	if sc.Paused != paused {
+		sc.Paused = paused
+		sc.NextRunAt = nil
+		if !paused {
+			next, err := nextRun(sc, time.Now())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			sc.NextRunAt = next
+		}
+		if err := h.db.UpdateSchedule(context.TODO(), &sc); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !paused {
+			h.runner.Wake()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sc)
+}
+
+// ScheduleRunner создаёт выражения по расписаниям. Время следующего запуска хранится в базе,
+// поэтому запуск, пропущенный, пока orchestrator был остановлен, выполняется один раз сразу
+// после старта, а дальше расписание идёт от текущего времени.
+type ScheduleRunner struct {
+	db        scheduleStore
+	scheduler *Scheduler
+	quotas    *Quotas
+	cache     *ResultCache
+	kick      chan struct{}
+}
+
+func NewScheduleRunner(db scheduleStore, scheduler *Scheduler, quotas *Quotas, cache *ResultCache) *ScheduleRunner {
+	return &ScheduleRunner{db: db, scheduler: scheduler, quotas: quotas, cache: cache, kick: make(chan struct{}, 1)}
+}
+
+// Wake сообщает о новом или возобновлённом расписании, чтобы таймер учёл его время
+func (s *ScheduleRunner) Wake() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run запускает расписания по таймеру, заведённому на ближайший запуск
+func (s *ScheduleRunner) Run(ctx context.Context) {
+	runTimer(ctx, s.kick, "run schedules", s.Fire)
+}
+
+// Fire создаёт выражения для расписаний, время которых наступило к now, удаляет старые
+// запуски сверх keep и возвращает время следующего запуска или nil, если расписаний нет
+func (s *ScheduleRunner) Fire(ctx context.Context, now time.Time) (*time.Time, error) {
+	due, err := s.db.SelectDueSchedules(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range due {
+		next, err := nextRun(sc, now)
+		if err != nil {
+			log.Printf("schedule %d of user %d: %v", sc.ID, sc.UserID, err)
+			continue
+		}
+		// Запуск забирает тот, кто первым сдвинул next_run_at
+		ok, err := s.db.ClaimScheduleRun(ctx, sc.UserID, sc.ID, *sc.NextRunAt, *next)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		request := RequestCalc{Expression: sc.Expression, Priority: sc.Priority, ScheduleID: sc.ID}
+		_, err = submitExpression(ctx, s.db, s.scheduler, s.quotas, s.cache, sc.UserID, request)
+		if err != nil && !errors.Is(err, errInvalidExpression) {
+			// Запуск не считается, но остаётся в /runs с ошибкой; расписание продолжает работать
+			log.Printf("schedule %d of user %d: %v", sc.ID, sc.UserID, err)
+			s.failRun(ctx, sc, err)
+		}
+		if _, err := s.db.DeleteScheduleRuns(ctx, sc.UserID, sc.ID, sc.Keep); err != nil {
+			log.Printf("schedule %d of user %d: delete old runs: %v", sc.ID, sc.UserID, err)
+		}
+	}
+	return s.db.SelectNextScheduleRun(ctx)
+}
+
+// failRun сохраняет запуск, который не удалось создать (лимит пользователя, ошибка базы),
+// как посчитанное выражение со статусом-ошибкой. Некорректные выражения сохраняет submitExpression.
+func (s *ScheduleRunner) failRun(ctx context.Context, sc database.Schedule, runErr error) {
+	now := time.Now()
+	expr := database.Expression{
+		Expression:  sc.Expression,
+		Status:      runErr.Error(),
+		Priority:    sc.Priority,
+		ScheduleID:  sc.ID,
+		CompletedAt: &now,
+	}
+	if _, err := s.db.InsertExpressions(ctx, sc.UserID, []database.Expression{expr}); err != nil {
+		log.Printf("schedule %d of user %d: save failed run: %v", sc.ID, sc.UserID, err)
+	}
+}
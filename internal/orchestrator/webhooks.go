@@ -0,0 +1,368 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	SignatureHeader = "X-Signature-256"
+	AttemptHeader   = "X-Webhook-Attempt"
+
+	maxWebhookDelay = 10 * time.Minute
+	webhookTimeout  = 10 * time.Second
+	// webhookLease - через сколько повторить попытку, которая не закончилась: больше
+	// таймаута запроса с запасом
+	webhookLease = 6 * webhookTimeout
+	// webhookWorkers - сколько попыток отправляется одновременно, webhookHostWorkers - сколько
+	// из них на один хост: медленный получатель задерживает только свои доставки
+	webhookWorkers     = 8
+	webhookHostWorkers = 2
+)
+
+var (
+	errIncorrectCallback = errors.New("incorrect callback_url")
+	errPrivateCallback   = errors.New("callback_url points to a private address")
+	// errNoWebhookSecret - без секрета получатель не отличит результат от подделки,
+	// поэтому callback_url не принимается, а неподписанные запросы не отправляются
+	errNoWebhookSecret = errors.New("callback_url is not supported: WEBHOOK_SECRET is not set")
+)
+
+type WebhookPayload struct {
+	ID     int64     `json:"id"`
+	Status string    `json:"status"`
+	Result float64   `json:"result"`
+	Time   time.Time `json:"time"`
+}
+
+// Webhooks отправляет результат выражения на его callback_url. Тело подписывается
+// HMAC-SHA256 с секретом WEBHOOK_SECRET (без секрета callback_url не принимается), каждая попытка записывается в webhook_deliveries.
+// Недоставленные результаты хранятся в очереди webhook_queue со временем следующей попытки,
+// её разбирает один Run, а отправляют до webhookWorkers горутин; неудачные попытки
+// повторяются с экспоненциальной задержкой, в том числе после перезапуска orchestrator.
+type Webhooks struct {
+	db          webhookStore
+	client      *http.Client
+	secret      []byte
+	maxAttempts int
+	baseDelay   time.Duration
+	// allowPrivate разрешает callback_url в локальной сети и на самом сервере
+	allowPrivate bool
+	kick         chan struct{}
+
+	mu       sync.Mutex
+	sending  int            // попыток в работе
+	hosts    map[string]int // попыток в работе по хостам
+	inFlight sync.WaitGroup
+}
+
+func NewWebhooks(db webhookStore) *Webhooks {
+	maxAttempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	baseDelay, err := strconv.Atoi(os.Getenv("WEBHOOK_RETRY_BASE_MS"))
+	if err != nil || baseDelay <= 0 {
+		baseDelay = 1000
+	}
+
+	allowPrivate, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE"))
+
+	wh := &Webhooks{
+		db:           db,
+		client:       &http.Client{Timeout: webhookTimeout},
+		secret:       []byte(os.Getenv("WEBHOOK_SECRET")),
+		maxAttempts:  maxAttempts,
+		baseDelay:    time.Duration(baseDelay) * time.Millisecond,
+		allowPrivate: allowPrivate,
+		kick:         make(chan struct{}, 1),
+	}
+	if !allowPrivate {
+		wh.client = publicClient(webhookTimeout)
+	}
+	if len(wh.secret) == 0 {
+		log.Printf("ВНИМАНИЕ: WEBHOOK_SECRET не задан, выражения с callback_url отклоняются")
+	}
+	return wh
+}
+
+// webhookStore - выражения, результат которых доставляется, и очередь доставки
+type webhookStore interface {
+	database.ExpressionStore
+	database.WebhookStore
+}
+
+// Sign возвращает значение заголовка X-Signature-256 для тела запроса
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateCallback проверяет callback_url: задан секрет для подписи, схема http или https,
+// а имя хоста разрешается только в публичные адреса
+func (wh *Webhooks) validateCallback(ctx context.Context, callback string) error {
+	if callback == "" {
+		return nil
+	}
+	if wh == nil || len(wh.secret) == 0 {
+		return errNoWebhookSecret
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errIncorrectCallback
+	}
+	if wh.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return errIncorrectCallback
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return errPrivateCallback
+		}
+	}
+	return nil
+}
+
+// publicAddr сообщает, можно ли отправлять запросы на адрес. Запрещены адреса самого
+// сервера, локальной сети и link-local, в том числе 169.254.169.254 метаданных облака.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsMulticast()
+}
+
+// publicClient - HTTP клиент, который соединяется только с публичными адресами. Адрес
+// проверяется при каждом соединении, уже после разрешения имени, поэтому ни смена DNS
+// записи после validateCallback, ни перенаправление не ведут во внутреннюю сеть.
+func publicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(addrPort.Addr()) {
+				return errPrivateCallback
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Через прокси соединение шло бы с адресом прокси, а не получателя
+	transport.Proxy = nil
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Enqueue ставит результат выражения в очередь доставки, если у выражения есть callback_url
+func (wh *Webhooks) Enqueue(ctx context.Context, userID, exprID int64) {
+	if wh == nil {
+		return
+	}
+	expr, err := firstExpression(wh.db.SelectExpression(ctx, userID, exprID))
+	if err != nil || expr.CallbackURL == "" {
+		return
+	}
+	now := time.Now()
+	p := database.PendingWebhook{UserID: userID, ExpressionID: exprID, URL: expr.CallbackURL, NextAttemptAt: now, CreatedAt: now}
+	if err := wh.db.InsertPendingWebhook(ctx, &p); err != nil {
+		log.Printf("Expression %d: failed to enqueue webhook: %v", exprID, err)
+		return
+	}
+	wh.wake()
+}
+
+func (wh *Webhooks) wake() {
+	select {
+	case wh.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run доставляет результаты по таймеру, заведённому на ближайшую попытку. Очередь хранится
+// в базе, поэтому доставки, не законченные до остановки, продолжаются сразу после запуска.
+func (wh *Webhooks) Run(ctx context.Context) {
+	runTimer(ctx, wh.kick, "deliver webhooks", wh.Deliver)
+}
+
+// Deliver раздаёт отправителям попытки доставки, время которых наступило к now, и не ждёт
+// их окончания. Возвращает время следующей попытки или nil, если очередь пуста. Попытки,
+// которым не хватило отправителя, ждут: закончившийся отправитель будит Run.
+func (wh *Webhooks) Deliver(ctx context.Context, now time.Time) (*time.Time, error) {
+	due, err := wh.db.SelectDueWebhooks(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	waiting := false
+	for _, p := range due {
+		host := callbackHost(p.URL)
+		if !wh.acquire(host) {
+			waiting = true
+			continue
+		}
+		// Попытку забирает тот, кто первым сдвинул next_attempt_at. Если orchestrator
+		// остановится во время отправки, попытка повторится через webhookLease.
+		ok, err := wh.db.ClaimPendingWebhook(ctx, p.UserID, p.ExpressionID, p.NextAttemptAt, now.Add(webhookLease))
+		if err != nil || !ok {
+			wh.release(host)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		wh.inFlight.Add(1)
+		go func() {
+			defer wh.inFlight.Done()
+			wh.attempt(ctx, p)
+			wh.release(host)
+			wh.wake()
+		}()
+	}
+	if waiting {
+		return nil, nil
+	}
+	return wh.db.SelectNextWebhookAttempt(ctx)
+}
+
+// acquire занимает отправителя для хоста, если свободен и общий, и хостовый
+func (wh *Webhooks) acquire(host string) bool {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.hosts == nil {
+		wh.hosts = make(map[string]int)
+	}
+	if wh.sending >= webhookWorkers || wh.hosts[host] >= webhookHostWorkers {
+		return false
+	}
+	wh.sending++
+	wh.hosts[host]++
+	return true
+}
+
+func (wh *Webhooks) release(host string) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.sending--
+	if wh.hosts[host]--; wh.hosts[host] == 0 {
+		delete(wh.hosts, host)
+	}
+}
+
+// callbackHost - хост и порт получателя, по которому ограничиваются одновременные попытки
+func callbackHost(callback string) string {
+	if u, err := url.Parse(callback); err == nil {
+		return u.Host
+	}
+	return callback
+}
+
+// attempt отправляет результат один раз, записывает попытку и убирает доставку из очереди
+// или назначает следующую попытку
+func (wh *Webhooks) attempt(ctx context.Context, p database.PendingWebhook) {
+	expr, err := firstExpression(wh.db.SelectExpression(ctx, p.UserID, p.ExpressionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.db.DeletePendingWebhook(ctx, p.UserID, p.ExpressionID)
+		return
+	}
+	if err != nil {
+		log.Printf("Expression %d: webhook: %v", p.ExpressionID, err)
+		return
+	}
+
+	// Время в теле - время постановки в очередь, поэтому все попытки отправляют одно и то же
+	body, err := json.Marshal(WebhookPayload{ID: expr.ID, Status: expr.Status, Result: expr.Result, Time: p.CreatedAt})
+	if err != nil {
+		return
+	}
+	p.Attempt++
+	// Доставка могла попасть в очередь до того, как секрет убрали. Без подписи она не
+	// отправляется, а повторять её бесполезно
+	var statusCode int
+	if len(wh.secret) == 0 {
+		err = errNoWebhookSecret
+		p.Attempt = max(p.Attempt, wh.maxAttempts)
+	} else {
+		statusCode, err = wh.post(ctx, p.URL, body, Sign(wh.secret, body), p.Attempt)
+	}
+
+	d := database.WebhookDelivery{
+		UserID:       p.UserID,
+		ExpressionID: p.ExpressionID,
+		URL:          p.URL,
+		Attempt:      p.Attempt,
+		StatusCode:   statusCode,
+		CreatedAt:    time.Now(),
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if _, dbErr := wh.db.InsertWebhookDelivery(ctx, &d); dbErr != nil {
+		log.Printf("Expression %d: failed to record webhook delivery: %v", p.ExpressionID, dbErr)
+	}
+
+	if err != nil && p.Attempt < wh.maxAttempts {
+		p.NextAttemptAt = time.Now().Add(wh.retryDelay(p.Attempt))
+		if err := wh.db.UpdatePendingWebhook(ctx, &p); err != nil {
+			log.Printf("Expression %d: failed to schedule webhook retry: %v", p.ExpressionID, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Expression %d: webhook to %s failed after %d attempts: %v", p.ExpressionID, p.URL, p.Attempt, err)
+	}
+	if err := wh.db.DeletePendingWebhook(ctx, p.UserID, p.ExpressionID); err != nil {
+		log.Printf("Expression %d: failed to remove delivered webhook: %v", p.ExpressionID, err)
+	}
+}
+
+// retryDelay - задержка после attempt неудачных попыток: baseDelay, дальше вдвое больше,
+// но не больше maxWebhookDelay
+func (wh *Webhooks) retryDelay(attempt int) time.Duration {
+	delay := wh.baseDelay
+	for i := 1; i < attempt && delay < maxWebhookDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookDelay)
+}
+
+func (wh *Webhooks) post(ctx context.Context, callback string, body []byte, signature string, attempt int) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
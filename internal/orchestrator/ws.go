@@ -0,0 +1,277 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+	wsSendBuffer   = 64
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// WSMessage - сообщение в обе стороны. Клиент отправляет submit, subscribe и unsubscribe,
+// сервер отвечает submitted, subscribed, unsubscribed, result и error.
+type WSMessage struct {
+	Type       string  `json:"type"`
+	RequestID  string  `json:"requestID,omitempty"`
+	Expression string  `json:"expression,omitempty"`
+	Priority   int     `json:"priority,omitempty"`
+	ID         int64   `json:"id,omitempty"`
+	Status     string  `json:"status,omitempty"`
+	Result     float64 `json:"result,omitempty"`
+	Message    string  `json:"message,omitempty"`
+	Code       string  `json:"code,omitempty"`
+}
+
+type WSHandler struct {
+	db        database.Store
+	hub       *Hub
+	scheduler *Scheduler
+	quotas    *Quotas
+	cache     *ResultCache
+	upgrader  websocket.Upgrader
+}
+
+func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	user, err := userFromToken(r.Context(), h.db, token)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &wsClient{
+		db:         h.db,
+		scheduler:  h.scheduler,
+		quotas:     h.quotas,
+		cache:      h.cache,
+		conn:       conn,
+		userID:     user.ID,
+		send:       make(chan WSMessage, wsSendBuffer),
+		done:       make(chan struct{}),
+		subscribed: map[int64]bool{},
+	}
+	events, cancel := h.hub.Subscribe(func(e Event) bool {
+		return e.UserID == c.userID && e.final() && c.isSubscribed(e.ExpressionID)
+	})
+	defer cancel()
+
+	go c.writeLoop(events)
+	c.readLoop()
+}
+
+// userFromToken проверяет JWT, выданный /api/v1/login, так же как вход по токену
+func userFromToken(ctx context.Context, db database.UserStore, token string) (database.User, error) {
+	if token == "" {
+		return database.User{}, errUnauthorized
+	}
+	m, err := DecodeToken(token)
+	if err != nil {
+		return database.User{}, errUnauthorized
+	}
+	username, ok := m["username"]
+	if !ok {
+		return database.User{}, errUnauthorized
+	}
+	password, ok := m["password"]
+	if !ok {
+		return database.User{}, errUnauthorized
+	}
+
+	u, err := db.SelectUser(ctx, fmt.Sprint(username))
+	if err != nil || u.ID == 0 {
+		return database.User{}, errUnauthorized
+	}
+	if err := database.ComparePassword(u.Password, fmt.Sprint(password)); err != nil {
+		return database.User{}, errUnauthorized
+	}
+	return u, nil
+}
+
+type wsClient struct {
+	db        database.Store
+	scheduler *Scheduler
+	quotas    *Quotas
+	cache     *ResultCache
+	conn      *websocket.Conn
+	userID    int64
+	send      chan WSMessage
+	done      chan struct{}
+
+	mu         sync.Mutex
+	subscribed map[int64]bool
+}
+
+func (c *wsClient) isSubscribed(exprID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscribed[exprID]
+}
+
+func (c *wsClient) setSubscribed(exprID int64, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.subscribed[exprID] = true
+	} else {
+		delete(c.subscribed, exprID)
+	}
+}
+
+// takeSubscription снимает подписку и сообщает, была ли она, чтобы результат ушёл ровно один раз
+func (c *wsClient) takeSubscription(exprID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok := c.subscribed[exprID]
+	delete(c.subscribed, exprID)
+	return ok
+}
+
+func (c *wsClient) reply(m WSMessage) {
+	select {
+	case c.send <- m:
+	case <-c.done:
+	}
+}
+
+func (c *wsClient) readLoop() {
+	defer func() {
+		close(c.done)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxBodyBytes())
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var m WSMessage
+		err := c.conn.ReadJSON(&m)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.reply(WSMessage{Type: "error", Message: "incorrect message"})
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.handle(m)
+	}
+}
+
+func (c *wsClient) handle(m WSMessage) {
+	switch m.Type {
+	case "submit":
+		if err := validatePriority(m.Priority); err != nil {
+			c.reply(WSMessage{Type: "error", RequestID: m.RequestID, Message: err.Error()})
+			return
+		}
+		if err := c.quotas.allowRequest(context.TODO(), c.userID); err != nil {
+			c.reply(WSMessage{Type: "error", RequestID: m.RequestID, Message: err.Error(), Code: limitCode(err)})
+			return
+		}
+		expr, err := submitExpression(context.TODO(), c.db, c.scheduler, c.quotas, c.cache, c.userID, RequestCalc{Expression: m.Expression, Priority: m.Priority})
+		if errors.Is(err, errInvalidExpression) {
+			c.reply(WSMessage{Type: "error", RequestID: m.RequestID, ID: expr.ID, Status: expr.Status, Message: err.Error()})
+			return
+		}
+		if code := limitCode(err); code != "" {
+			c.reply(WSMessage{Type: "error", RequestID: m.RequestID, Message: err.Error(), Code: code})
+			return
+		}
+		if err != nil {
+			c.reply(WSMessage{Type: "error", RequestID: m.RequestID, Message: "internal error"})
+			return
+		}
+		c.reply(WSMessage{Type: "submitted", RequestID: m.RequestID, ID: expr.ID, Status: expr.Status, Result: expr.Result})
+		c.subscribe(m.RequestID, expr.ID, false)
+	case "subscribe":
+		c.subscribe(m.RequestID, m.ID, true)
+	case "unsubscribe":
+		c.setSubscribed(m.ID, false)
+		c.reply(WSMessage{Type: "unsubscribed", RequestID: m.RequestID, ID: m.ID})
+	default:
+		c.reply(WSMessage{Type: "error", RequestID: m.RequestID, Message: "unknown message type"})
+	}
+}
+
+// subscribe подписывает на результат выражения. Подписка оформляется до чтения из базы,
+// поэтому результат не теряется, даже если выражение завершится между ними.
+func (c *wsClient) subscribe(requestID string, exprID int64, confirm bool) {
+	c.setSubscribed(exprID, true)
+
+	expr, err := firstExpression(c.db.SelectExpression(context.TODO(), c.userID, exprID))
+	if err != nil {
+		c.setSubscribed(exprID, false)
+		c.reply(WSMessage{Type: "error", RequestID: requestID, ID: exprID, Message: "expression not found"})
+		return
+	}
+	if confirm {
+		c.reply(WSMessage{Type: "subscribed", RequestID: requestID, ID: exprID, Status: expr.Status})
+	}
+	if isFinished(expr.Status) && c.takeSubscription(exprID) {
+		c.reply(WSMessage{Type: "result", ID: exprID, Status: expr.Status, Result: expr.Result})
+	}
+}
+
+func (c *wsClient) writeLoop(events <-chan Event) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	write := func(m WSMessage) error {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return c.conn.WriteJSON(m)
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.send:
+			if err := write(m); err != nil {
+				c.conn.Close()
+				return
+			}
+		case e := <-events:
+			if !c.takeSubscription(e.ExpressionID) {
+				continue
+			}
+			if err := write(WSMessage{Type: "result", ID: e.ExpressionID, Status: e.Status, Result: e.Result}); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -4,11 +4,104 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/hidnt/lms_yandex_final/pkg/database"
 )
 
-func Calc(expression string) (database.Expression, error) {
+type compiler struct {
+	actions []database.Action
+	vars    map[string]string
+	funcs   map[string]database.Function
+	stack   []string
+	inlined int
+}
+
+func Calc(expression string, funcs ...database.Function) (database.Expression, error) {
+	if err := CheckInput(expression); err != nil {
+		return database.Expression{}, err
+	}
+
+	c := &compiler{vars: map[string]string{}, funcs: map[string]database.Function{}}
+	for _, f := range funcs {
+		c.funcs[f.Name] = f
+	}
+	var variables []database.Variable
+	var root string
+
+	for _, statement := range strings.Split(expression, ";") {
+		if strings.TrimSpace(statement) == "" && root != "" {
+			continue
+		}
+
+		name, body, isAssignment := strings.Cut(statement, "=")
+		if !isAssignment {
+			body = statement
+		}
+
+		parts, err := tokenize(body)
+		if err != nil {
+			return database.Expression{}, err
+		}
+		if err := checkDepth(parts); err != nil {
+			return database.Expression{}, err
+		}
+		node, err := c.compile(parts)
+		if err != nil {
+			return database.Expression{}, err
+		}
+
+		if isAssignment {
+			name = strings.TrimSpace(name)
+			if !isIdent(name) {
+				return database.Expression{}, ErrIncorrectAssignment
+			}
+			c.vars[name] = node
+			variables = append(variables, variable(name, node))
+		}
+		root = node
+	}
+
+	// Результат выражения - всегда последнее действие, поэтому для числа или уже
+	// посчитанной ранее переменной добавляем действие "+ 0"
+	if n, err := strconv.ParseFloat(root, 64); err == nil {
+		c.actions = append(c.actions, database.Action{
+			Arg1:         n,
+			Arg2:         0,
+			Result:       0,
+			Operation:    "+",
+			IdDepends:    []int64{-1, -1},
+			Completed:    false,
+			NowCalculate: false,
+		})
+	} else if root != fmt.Sprintf("d%d", len(c.actions)) {
+		n, err := strconv.ParseInt(root[1:], 10, 64)
+		if err != nil {
+			return database.Expression{}, err
+		}
+		c.actions = append(c.actions, database.Action{
+			Arg1:         0,
+			Arg2:         0,
+			Result:       0,
+			Operation:    "+",
+			IdDepends:    []int64{n, -1},
+			Completed:    false,
+			NowCalculate: false,
+		})
+	}
+
+	exprs := database.Expression{
+		Status:    "under consideration",
+		Result:    0,
+		Actions:   c.actions,
+		Variables: variables,
+	}
+
+	return exprs, nil
+}
+
+func tokenize(expression string) ([]string, error) {
 	var parts []string
 	var curPart string
 	var lastIsNotNumber bool = false
@@ -20,7 +113,7 @@ func Calc(expression string) (database.Expression, error) {
 			curPart += string(char)
 			continue
 		}
-		if strings.ContainsAny(string(char), "0123456789.") {
+		if strings.ContainsAny(string(char), "0123456789.") || isIdentChar(char) {
 			if lastIsNotNumber && curPart == "-" {
 				parts = append(parts, curPart)
 				curPart = ""
@@ -38,7 +131,7 @@ func Calc(expression string) (database.Expression, error) {
 			parts = append(parts, curPart)
 			curPart = ""
 		}
-		if strings.ContainsAny(string(char), "+*/()") {
+		if strings.ContainsAny(string(char), "+*/(),") {
 			parts = append(parts, string(char))
 			lastIsNotNumber = false
 			if string(char) == ")" {
@@ -50,17 +143,21 @@ func Calc(expression string) (database.Expression, error) {
 			curPart += "-"
 			continue
 		}
-		return database.Expression{}, ErrUnknownOp
+		return nil, ErrUnknownOp
 	}
 
 	if curPart != "" {
 		parts = append(parts, curPart)
 	}
 
+	return parts, nil
+}
+
+// compile добавляет действия для одного выражения и возвращает его узел:
+// число или ссылку на действие вида "d<номер>"
+func (c *compiler) compile(parts []string) (string, error) {
 	var nums []string
 	var operators []string
-	var actions []database.Action
-	curAction := 1
 
 	priority := map[string]int{
 		"+": 1,
@@ -79,54 +176,44 @@ func Calc(expression string) (database.Expression, error) {
 			return err
 		}
 
-		depends := []int64{}
-		var left, right float64
-
-		if num, err := strconv.ParseFloat(nums[len(nums)-2], 64); err == nil {
-			left = num
-			depends = append(depends, -1)
-		} else {
-			left = 0
-			n, err := strconv.ParseInt(nums[len(nums)-2][1:], 10, 64)
-			if err != nil {
-				return err
-			}
-			depends = append(depends, n)
-		}
-		if num, err := strconv.ParseFloat(nums[len(nums)-1], 64); err == nil {
-			right = num
-			depends = append(depends, -1)
-		} else {
-			right = 0
-			n, err := strconv.ParseInt(nums[len(nums)-1][1:], 10, 64)
-			if err != nil {
-				return err
-			}
-			depends = append(depends, n)
-		}
-		nums = nums[:len(nums)-2]
-
 		operator := operators[len(operators)-1]
 		operators = operators[:len(operators)-1]
 
-		actions = append(actions, database.Action{
-			Arg1:         left,
-			Arg2:         right,
-			Result:       0,
-			Operation:    operator,
-			IdDepends:    depends,
-			Completed:    false,
-			NowCalculate: false,
-		})
-
-		nums = append(nums, fmt.Sprintf("d%d", curAction))
-		curAction++
+		node, err := c.addAction(operator, nums[len(nums)-2], nums[len(nums)-1])
+		if err != nil {
+			return err
+		}
+		nums = nums[:len(nums)-2]
+		nums = append(nums, node)
 
 		return nil
 	}
 
-	for _, part := range parts {
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		if name := strings.TrimPrefix(part, "-"); name != "" && isIdentStart(firstRune(name)) {
+			var node string
+			var err error
+			if i+1 < len(parts) && parts[i+1] == "(" {
+				var args [][]string
+				i, args, err = splitArgs(parts, i+1)
+				if err != nil {
+					return "", err
+				}
+				node, err = c.call(part, args)
+			} else {
+				node, err = c.variable(part)
+			}
+			if err != nil {
+				return "", err
+			}
+			nums = append(nums, node)
+			continue
+		}
 		if _, err := strconv.ParseFloat(part, 64); err == nil {
+			if strings.ContainsFunc(part, isIdentStart) {
+				return "", ErrUnknownOp
+			}
 			nums = append(nums, part)
 			continue
 		}
@@ -134,20 +221,26 @@ func Calc(expression string) (database.Expression, error) {
 			operators = append(operators, part)
 			continue
 		}
+		if part == "," {
+			return "", ErrIncorrectArgs
+		}
 		if part == ")" {
 			for len(operators) > 0 && operators[len(operators)-1] != "(" {
 				if err := calculate(); err != nil {
-					return database.Expression{}, err
+					return "", err
 				}
 			}
 			if len(operators) == 0 {
-				return database.Expression{}, ErrIncorrectPriorOp
+				return "", ErrIncorrectPriorOp
 			}
 			operators = operators[:len(operators)-1]
 		} else {
+			if _, ok := priority[part]; !ok {
+				return "", ErrUnknownOp
+			}
 			for len(operators) > 0 && priority[operators[len(operators)-1]] >= priority[part] {
 				if err := calculate(); err != nil {
-					return database.Expression{}, err
+					return "", err
 				}
 			}
 			operators = append(operators, part)
@@ -156,33 +249,113 @@ func Calc(expression string) (database.Expression, error) {
 
 	for len(operators) > 0 {
 		if err := calculate(); err != nil {
-			return database.Expression{}, err
+			return "", err
 		}
 	}
 
 	if len(nums) != 1 {
-		return database.Expression{}, ErrCalc
+		return "", ErrCalc
+	}
+
+	return nums[0], nil
+}
+
+func (c *compiler) addAction(operator, left, right string) (string, error) {
+	depends := []int64{}
+	var arg1, arg2 float64
+
+	for i, node := range []string{left, right} {
+		if num, err := strconv.ParseFloat(node, 64); err == nil {
+			if i == 0 {
+				arg1 = num
+			} else {
+				arg2 = num
+			}
+			depends = append(depends, -1)
+		} else {
+			n, err := strconv.ParseInt(node[1:], 10, 64)
+			if err != nil {
+				return "", err
+			}
+			depends = append(depends, n)
+		}
 	}
 
-	if len(nums) == 1 && len(actions) == 0 {
-		if n, err := strconv.ParseFloat(nums[0], 64); err == nil {
-			actions = append(actions, database.Action{
-				Arg1:         n,
-				Arg2:         0,
-				Result:       0,
-				Operation:    "+",
-				IdDepends:    []int64{-1, -1},
-				Completed:    false,
-				NowCalculate: false,
-			})
+	if MaxActions > 0 && len(c.actions) >= MaxActions {
+		return "", ErrTooManyActions
+	}
+	if len(c.stack) > 0 {
+		c.inlined++
+		if c.inlined > MaxInlineActions {
+			return "", ErrExpansionTooLarge
 		}
 	}
 
-	exprs := database.Expression{
-		Status:  "under consideration",
-		Result:  0,
-		Actions: actions,
+	c.actions = append(c.actions, database.Action{
+		Arg1:         arg1,
+		Arg2:         arg2,
+		Result:       0,
+		Operation:    operator,
+		IdDepends:    depends,
+		Completed:    false,
+		NowCalculate: false,
+	})
+
+	return fmt.Sprintf("d%d", len(c.actions)), nil
+}
+
+// variable возвращает узел переменной, для "-имя" значение берётся с обратным знаком
+func (c *compiler) variable(part string) (string, error) {
+	name, negative := strings.CutPrefix(part, "-")
+	if !isIdent(name) {
+		return "", ErrUnknownOp
+	}
+	node, ok := c.vars[name]
+	if !ok {
+		return "", ErrUnknownVariable
+	}
+	if !negative {
+		return node, nil
 	}
+	return c.negate(node)
+}
 
-	return exprs, nil
+func (c *compiler) negate(node string) (string, error) {
+	if n, err := strconv.ParseFloat(node, 64); err == nil {
+		return strconv.FormatFloat(-n, 'g', -1, 64), nil
+	}
+	return c.addAction("-", "0", node)
+}
+
+func variable(name, node string) database.Variable {
+	if n, err := strconv.ParseFloat(node, 64); err == nil {
+		return database.Variable{Name: name, ActionID: -1, Value: n}
+	}
+	id, _ := strconv.ParseInt(node[1:], 10, 64)
+	return database.Variable{Name: name, ActionID: id}
+}
+
+func isIdentStart(char rune) bool {
+	return char == '_' || unicode.IsLetter(char)
+}
+
+func isIdentChar(char rune) bool {
+	return isIdentStart(char) || unicode.IsDigit(char)
+}
+
+func isIdent(s string) bool {
+	if s == "" || !isIdentStart(firstRune(s)) {
+		return false
+	}
+	for _, char := range s {
+		if !isIdentChar(char) {
+			return false
+		}
+	}
+	return true
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
 }
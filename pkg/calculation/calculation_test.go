@@ -2,6 +2,7 @@ package calculation
 
 import (
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/hidnt/lms_yandex_final/pkg/database"
@@ -133,3 +134,337 @@ func TestCalc(t *testing.T) {
 		})
 	}
 }
+
+func TestFold(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expression string
+		maxActions int
+		wantResult float64
+		wantIds    [][]int64
+	}{
+		{
+			name:       "disabled",
+			expression: "1+2*3",
+			maxActions: 0,
+			wantIds:    [][]int64{{-1, -1}, {-1, 1}},
+		},
+		{
+			name:       "bare number",
+			expression: "5",
+			maxActions: 1,
+			wantResult: 5,
+		},
+		{
+			name:       "bare number without folding",
+			expression: "-2.5",
+			maxActions: 0,
+			wantResult: -2.5,
+		},
+		{
+			name:       "number variable without folding",
+			expression: "a = 4; a",
+			maxActions: 0,
+			wantResult: 4,
+		},
+		{
+			name:       "whole expression",
+			expression: "1+2*3",
+			maxActions: 2,
+			wantResult: 7,
+		},
+		{
+			name:       "small subtrees",
+			expression: "(1+2)*(3+4)-8",
+			maxActions: 1,
+			wantIds:    [][]int64{{-1, -1}, {1, -1}},
+		},
+		{
+			name:       "division by zero stays for agents",
+			expression: "1/0",
+			maxActions: 5,
+			wantIds:    [][]int64{{-1, -1}},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			expr, err := Calc(testCase.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			ans := Fold(expr, testCase.maxActions)
+			if testCase.wantIds == nil {
+				if len(ans.Actions) != 0 || ans.Status != "completed" || ans.Result != testCase.wantResult {
+					t.Fatalf("want completed with %v, have %v", testCase.wantResult, ans)
+				}
+				return
+			}
+			if len(ans.Actions) != len(testCase.wantIds) {
+				t.Fatalf("want %d actions, have %v", len(testCase.wantIds), ans.Actions)
+			}
+			for i, a := range ans.Actions {
+				if !slices.Equal(a.IdDepends, testCase.wantIds[i]) {
+					t.Fatalf("action %d depends on %v, want %v", i+1, a.IdDepends, testCase.wantIds[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCalcScript(t *testing.T) {
+	testCases := []struct {
+		name          string
+		expression    string
+		wantIds       [][]int64
+		wantVariables []database.Variable
+		wantError     error
+	}{
+		{
+			name:       "literal bindings",
+			expression: "rate = 0.2; base = 1200; base * (1 + rate)",
+			wantIds:    [][]int64{{-1, -1}, {-1, 1}},
+			wantVariables: []database.Variable{
+				{Name: "rate", ActionID: -1, Value: 0.2},
+				{Name: "base", ActionID: -1, Value: 1200},
+			},
+		},
+		{
+			name:       "bindings to actions",
+			expression: "a = 1 + 2; b = a * a; a",
+			wantIds:    [][]int64{{-1, -1}, {1, 1}, {1, -1}},
+			wantVariables: []database.Variable{
+				{Name: "a", ActionID: 1},
+				{Name: "b", ActionID: 2},
+			},
+		},
+		{
+			name:       "negated variable",
+			expression: "x = 2 * 3; y = 4; -x - -y;",
+			wantIds:    [][]int64{{-1, -1}, {-1, 1}, {2, -1}},
+			wantVariables: []database.Variable{
+				{Name: "x", ActionID: 1},
+				{Name: "y", ActionID: -1, Value: 4},
+			},
+		},
+		{
+			name:       "unknown variable",
+			expression: "a = 1; a + b",
+			wantError:  ErrUnknownVariable,
+		},
+		{
+			name:       "incorrect assignment",
+			expression: "1a = 1; 2",
+			wantError:  ErrIncorrectAssignment,
+		},
+		{
+			name:       "number with letters",
+			expression: "2rate + 1",
+			wantError:  ErrUnknownOp,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ans, err := Calc(testCase.expression)
+			if testCase.wantError != nil {
+				if err != testCase.wantError {
+					t.Fatalf("want error %v, have %v", testCase.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(ans.Actions) != len(testCase.wantIds) {
+				t.Fatalf("want %d actions, have %v", len(testCase.wantIds), ans.Actions)
+			}
+			for i, a := range ans.Actions {
+				if !slices.Equal(a.IdDepends, testCase.wantIds[i]) {
+					t.Fatalf("action %d depends on %v, want %v", i+1, a.IdDepends, testCase.wantIds[i])
+				}
+			}
+			if !slices.Equal(ans.Variables, testCase.wantVariables) {
+				t.Fatalf("want variables %v, have %v", testCase.wantVariables, ans.Variables)
+			}
+		})
+	}
+}
+
+func TestCalcFunctions(t *testing.T) {
+	vat, err := ParseFunction("vat(x) = x * 1.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if vat.Name != "vat" || !slices.Equal(vat.Params, []string{"x"}) || vat.Body != "x * 1.2" {
+		t.Fatalf("incorrect function %v", vat)
+	}
+	avg, err := ParseFunction("avg(a, b) = (a + b) / 2", vat)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	big := database.Function{Name: "big", Params: []string{"x"}, Body: "x + x + x + x + x + x + x + x + x + x"}
+	funcs := []database.Function{vat, avg, big}
+
+	testCases := []struct {
+		name       string
+		expression string
+		wantIds    [][]int64
+		wantError  error
+	}{
+		{
+			name:       "inline",
+			expression: "vat(100) + 1",
+			wantIds:    [][]int64{{-1, -1}, {1, -1}},
+		},
+		{
+			name:       "nested calls",
+			expression: "-vat(avg(1, 2 * 3))",
+			wantIds:    [][]int64{{-1, -1}, {-1, 1}, {2, -1}, {3, -1}, {-1, 4}},
+		},
+		{
+			name:       "unknown function",
+			expression: "tax(1)",
+			wantError:  ErrUnknownFunction,
+		},
+		{
+			name:       "wrong arguments",
+			expression: "avg(1)",
+			wantError:  ErrIncorrectArgs,
+		},
+		{
+			name:       "expansion limit",
+			expression: "big(big(1))",
+			wantError:  ErrExpansionTooLarge,
+		},
+	}
+
+	limit := MaxInlineActions
+	MaxInlineActions = 16
+	defer func() { MaxInlineActions = limit }()
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ans, err := Calc(testCase.expression, funcs...)
+			if testCase.wantError != nil {
+				if err != testCase.wantError {
+					t.Fatalf("want error %v, have %v", testCase.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(ans.Actions) != len(testCase.wantIds) {
+				t.Fatalf("want %d actions, have %v", len(testCase.wantIds), ans.Actions)
+			}
+			for i, a := range ans.Actions {
+				if !slices.Equal(a.IdDepends, testCase.wantIds[i]) {
+					t.Fatalf("action %d depends on %v, want %v", i+1, a.IdDepends, testCase.wantIds[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseFunction(t *testing.T) {
+	f := database.Function{Name: "f", Params: []string{"x"}, Body: "g(x) + 1"}
+	testCases := []struct {
+		name       string
+		definition string
+		wantError  error
+	}{
+		{name: "no body", definition: "g(x) =", wantError: ErrIncorrectFunction},
+		{name: "bad name", definition: "1g(x) = x", wantError: ErrIncorrectFunction},
+		{name: "duplicate params", definition: "g(x, x) = x", wantError: ErrIncorrectFunction},
+		{name: "unknown variable", definition: "g(x) = x + y", wantError: ErrUnknownVariable},
+		{name: "direct recursion", definition: "g(x) = g(x - 1)", wantError: ErrRecursion},
+		{name: "mutual recursion", definition: "g(x) = f(x) * 2", wantError: ErrRecursion},
+		{name: "correct", definition: "g(x) = x * 2", wantError: nil},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := ParseFunction(testCase.definition, f); err != testCase.wantError {
+				t.Fatalf("want error %v, have %v", testCase.wantError, err)
+			}
+		})
+	}
+}
+
+func TestCalcLimits(t *testing.T) {
+	defer func(bytes, tokens, depth, actions int) {
+		MaxInputBytes, MaxTokens, MaxDepth, MaxActions = bytes, tokens, depth, actions
+	}(MaxInputBytes, MaxTokens, MaxDepth, MaxActions)
+	MaxInputBytes, MaxTokens, MaxDepth, MaxActions = 64, 16, 3, 4
+
+	funcs := []database.Function{
+		{Name: "deep", Params: []string{"x"}, Body: "((((x))))"},
+		{Name: "many", Params: []string{"x"}, Body: "x+x+x+x+x+x"},
+	}
+	testCases := []struct {
+		name       string
+		expression string
+		wantError  error
+	}{
+		{name: "within limits", expression: "(1+2)*((3+4))"},
+		{name: "long input", expression: strings.Repeat(" ", 60) + "1+1+1", wantError: ErrInputTooLarge},
+		{name: "many tokens", expression: "1+1+1+1+1+1+1+1+1", wantError: ErrTooManyTokens},
+		{name: "tokens of all statements", expression: "a=1+1;a*a*a*a;a-a-a-a", wantError: ErrTooManyTokens},
+		{name: "deep", expression: "((((1))))", wantError: ErrTooDeep},
+		{name: "deep function body", expression: "deep(1)", wantError: ErrTooDeep},
+		{name: "many actions", expression: "many(1)", wantError: ErrTooManyActions},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := Calc(testCase.expression, funcs...); err != testCase.wantError {
+				t.Fatalf("want error %v, have %v", testCase.wantError, err)
+			}
+			// Без разбора проверяются только длина и число токенов
+			wantInput := testCase.wantError
+			if wantInput != ErrInputTooLarge && wantInput != ErrTooManyTokens {
+				wantInput = nil
+			}
+			if err := CheckInput(testCase.expression); err != wantInput {
+				t.Fatalf("want input error %v, have %v", wantInput, err)
+			}
+		})
+	}
+}
+
+func TestSubtreeKeys(t *testing.T) {
+	rootKey := func(expression string) Key {
+		expr, err := Calc(expression)
+		if err != nil {
+			t.Fatalf("Cannot calc %q: %v", expression, err)
+		}
+		keys := SubtreeKeys(expr.Actions)
+		return keys[len(keys)-1]
+	}
+
+	testCases := []struct {
+		a, b string
+		same bool
+	}{
+		{a: "2*3", b: "3*2", same: true},
+		{a: "2*3", b: "2.0*3", same: true},
+		{a: "(1+2)*(3+4)", b: "(4+3)*(2+1)", same: true},
+		{a: "a=1+2; a*a", b: "(2+1)*(1+2)", same: true},
+		{a: "2-3", b: "3-2"},
+		{a: "6/2", b: "2/6"},
+		{a: "1+2+3", b: "1+(2+3)"},
+		{a: "2*3", b: "2+3"},
+	}
+	for _, testCase := range testCases {
+		if same := rootKey(testCase.a) == rootKey(testCase.b); same != testCase.same {
+			t.Errorf("%q and %q: want same key %v, have %v", testCase.a, testCase.b, testCase.same, same)
+		}
+	}
+
+	// Поддерево с известными аргументами совпадает с действием из одних чисел
+	expr, _ := Calc("2*3+1")
+	keys := SubtreeKeys(expr.Actions)
+	if keys[0] != ActionKey("*", 3, 2) || keys[0] != rootKey("3*2") {
+		t.Errorf("Subtree key differs from action key")
+	}
+	if keys[1] == ActionKey("+", 6, 1) {
+		t.Errorf("Subtree key equals key of its value")
+	}
+}
@@ -0,0 +1,53 @@
+package calculation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strconv"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+// Key - хеш канонической записи поддерева: число записывается кратчайшим точным
+// представлением, а у сложения и умножения аргументы упорядочены, поэтому 2*3 и 3*2
+// дают один ключ. Поддеревья с одинаковым ключом имеют одинаковый результат.
+type Key [sha256.Size]byte
+
+// SubtreeKeys возвращает ключи поддеревьев с корнем в каждом действии.
+// Ключ выражения целиком - ключ последнего действия.
+func SubtreeKeys(actions []database.Action) []Key {
+	keys := make([]Key, len(actions))
+	for i, a := range actions {
+		left, right := numberKey(a.Arg1), numberKey(a.Arg2)
+		if d := a.IdDepends[0]; d != -1 {
+			left = keys[d-1]
+		}
+		if d := a.IdDepends[1]; d != -1 {
+			right = keys[d-1]
+		}
+		keys[i] = operationKey(a.Operation, left, right)
+	}
+	return keys
+}
+
+// ActionKey - ключ одного действия с уже известными аргументами
+func ActionKey(operation string, arg1, arg2 float64) Key {
+	return operationKey(operation, numberKey(arg1), numberKey(arg2))
+}
+
+func numberKey(x float64) Key {
+	return sha256.Sum256([]byte(strconv.FormatFloat(x, 'g', -1, 64)))
+}
+
+func operationKey(operation string, left, right Key) Key {
+	if (operation == "+" || operation == "*") && bytes.Compare(left[:], right[:]) > 0 {
+		left, right = right, left
+	}
+	h := sha256.New()
+	h.Write([]byte(operation))
+	h.Write(left[:])
+	h.Write(right[:])
+	var k Key
+	h.Sum(k[:0])
+	return k
+}
@@ -9,4 +9,18 @@ var (
 	ErrNotEnoughtNums   = errors.New("not enough nums")
 	ErrDivByZero        = errors.New("division by zero")
 	ErrCalc             = errors.New("calculation error")
+
+	ErrUnknownVariable     = errors.New("unknown variable")
+	ErrIncorrectAssignment = errors.New("incorrect assignment")
+
+	ErrUnknownFunction   = errors.New("unknown function")
+	ErrIncorrectFunction = errors.New("incorrect function definition")
+	ErrIncorrectArgs     = errors.New("incorrect number of arguments")
+	ErrRecursion         = errors.New("recursive function call")
+	ErrExpansionTooLarge = errors.New("function expansion is too large")
+
+	ErrInputTooLarge  = errors.New("expression is too long")
+	ErrTooManyTokens  = errors.New("expression has too many tokens")
+	ErrTooDeep        = errors.New("expression is nested too deeply")
+	ErrTooManyActions = errors.New("expression has too many actions")
 )
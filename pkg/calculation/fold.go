@@ -0,0 +1,122 @@
+package calculation
+
+import "github.com/hidnt/lms_yandex_final/pkg/database"
+
+// Fold вычисляет на месте поддеревья, в которых не больше maxActions действий.
+// Если свернуть удалось всё выражение, оно возвращается без действий и со статусом "completed".
+// Выражение из одного числа сворачивается всегда, даже если maxActions равен 0.
+func Fold(expr database.Expression, maxActions int) database.Expression {
+	if len(expr.Actions) == 1 && isConstant(expr.Actions[0]) {
+		maxActions = max(maxActions, 1)
+	}
+	if maxActions <= 0 || len(expr.Actions) == 0 {
+		return expr
+	}
+
+	size := make([]int, len(expr.Actions))
+	values := make([]float64, len(expr.Actions))
+	folded := make([]bool, len(expr.Actions))
+
+	for i, a := range expr.Actions {
+		size[i] = 1
+		canFold := true
+		left, right := a.Arg1, a.Arg2
+		if d := a.IdDepends[0]; d != -1 {
+			size[i] += size[d-1]
+			canFold = canFold && folded[d-1]
+			left = values[d-1]
+		}
+		if d := a.IdDepends[1]; d != -1 {
+			size[i] += size[d-1]
+			canFold = canFold && folded[d-1]
+			right = values[d-1]
+		}
+		if !canFold || size[i] > maxActions {
+			continue
+		}
+
+		res, err := apply(a.Operation, left, right)
+		if err != nil {
+			continue
+		}
+		values[i] = res
+		folded[i] = true
+	}
+
+	variables := make([]database.Variable, 0, len(expr.Variables))
+	for _, v := range expr.Variables {
+		if v.ActionID != -1 && folded[v.ActionID-1] {
+			v.Value = values[v.ActionID-1]
+			v.ActionID = -1
+		}
+		variables = append(variables, v)
+	}
+
+	if folded[len(folded)-1] {
+		return database.Expression{
+			Status:    "completed",
+			Result:    values[len(values)-1],
+			Variables: variables,
+		}
+	}
+
+	newIds := make([]int64, len(expr.Actions))
+	var actions []database.Action
+	for i, a := range expr.Actions {
+		if folded[i] {
+			continue
+		}
+		depends := []int64{-1, -1}
+		if d := a.IdDepends[0]; d != -1 {
+			if folded[d-1] {
+				a.Arg1 = values[d-1]
+			} else {
+				depends[0] = newIds[d-1]
+			}
+		}
+		if d := a.IdDepends[1]; d != -1 {
+			if folded[d-1] {
+				a.Arg2 = values[d-1]
+			} else {
+				depends[1] = newIds[d-1]
+			}
+		}
+		a.IdDepends = depends
+		actions = append(actions, a)
+		newIds[i] = int64(len(actions))
+	}
+
+	for i, v := range variables {
+		if v.ActionID != -1 {
+			variables[i].ActionID = newIds[v.ActionID-1]
+		}
+	}
+
+	expr.Actions = actions
+	if len(variables) > 0 {
+		expr.Variables = variables
+	}
+	return expr
+}
+
+// isConstant - действие "+ 0", которое Calc добавляет для выражения из одного числа
+func isConstant(a database.Action) bool {
+	return a.Operation == "+" && a.Arg2 == 0 && a.IdDepends[0] == -1 && a.IdDepends[1] == -1
+}
+
+func apply(operation string, arg1, arg2 float64) (float64, error) {
+	switch operation {
+	case "+":
+		return arg1 + arg2, nil
+	case "-":
+		return arg1 - arg2, nil
+	case "*":
+		return arg1 * arg2, nil
+	case "/":
+		if arg2 == 0 {
+			return 0, ErrDivByZero
+		}
+		return arg1 / arg2, nil
+	}
+	return 0, ErrUnknownOp
+}
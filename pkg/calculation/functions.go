@@ -0,0 +1,125 @@
+package calculation
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/hidnt/lms_yandex_final/pkg/database"
+)
+
+// MaxInlineActions - сколько действий может появиться при подстановке пользовательских функций в одно выражение
+var MaxInlineActions = 1000
+
+// ParseFunction разбирает определение вида "vat(x) = x * 1.2" и проверяет,
+// что функцию можно подставить вместе с уже существующими funcs.
+func ParseFunction(definition string, funcs ...database.Function) (database.Function, error) {
+	head, body, ok := strings.Cut(definition, "=")
+	if !ok || strings.TrimSpace(body) == "" {
+		return database.Function{}, ErrIncorrectFunction
+	}
+
+	name, params, ok := strings.Cut(strings.TrimSpace(head), "(")
+	params, closed := strings.CutSuffix(strings.TrimSpace(params), ")")
+	name = strings.TrimSpace(name)
+	if !ok || !closed || !isIdent(name) {
+		return database.Function{}, ErrIncorrectFunction
+	}
+
+	f := database.Function{Name: name, Params: []string{}, Body: strings.TrimSpace(body)}
+	if strings.TrimSpace(params) != "" {
+		for _, p := range strings.Split(params, ",") {
+			p = strings.TrimSpace(p)
+			if !isIdent(p) || slices.Contains(f.Params, p) {
+				return database.Function{}, ErrIncorrectFunction
+			}
+			f.Params = append(f.Params, p)
+		}
+	}
+
+	// Пробный вызов находит ошибки в теле, рекурсию и слишком большие подстановки
+	others := slices.DeleteFunc(slices.Clone(funcs), func(other database.Function) bool {
+		return other.Name == f.Name
+	})
+	args := strings.TrimSuffix(strings.Repeat("1,", len(f.Params)), ",")
+	if _, err := Calc(f.Name+"("+args+")", append(others, f)...); err != nil {
+		return database.Function{}, err
+	}
+
+	return f, nil
+}
+
+// call подставляет тело функции, связывая её параметры с узлами аргументов
+func (c *compiler) call(part string, args [][]string) (string, error) {
+	name, negative := strings.CutPrefix(part, "-")
+	f, ok := c.funcs[name]
+	if !ok {
+		return "", ErrUnknownFunction
+	}
+	if len(args) != len(f.Params) {
+		return "", ErrIncorrectArgs
+	}
+	if slices.Contains(c.stack, name) {
+		return "", ErrRecursion
+	}
+
+	scope := map[string]string{}
+	for i, arg := range args {
+		node, err := c.compile(arg)
+		if err != nil {
+			return "", err
+		}
+		scope[f.Params[i]] = node
+	}
+
+	parts, err := tokenize(f.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := checkDepth(parts); err != nil {
+		return "", err
+	}
+
+	vars := c.vars
+	c.vars = scope
+	c.stack = append(c.stack, name)
+	node, err := c.compile(parts)
+	c.stack = c.stack[:len(c.stack)-1]
+	c.vars = vars
+	if err != nil {
+		return "", err
+	}
+
+	if negative {
+		return c.negate(node)
+	}
+	return node, nil
+}
+
+// splitArgs делит аргументы вызова по запятым верхнего уровня и возвращает индекс закрывающей скобки
+func splitArgs(parts []string, open int) (int, [][]string, error) {
+	var args [][]string
+	var cur []string
+	depth := 0
+	for i := open + 1; i < len(parts); i++ {
+		switch parts[i] {
+		case "(":
+			depth++
+		case ")":
+			if depth == 0 {
+				if len(cur) > 0 || len(args) > 0 {
+					args = append(args, cur)
+				}
+				return i, args, nil
+			}
+			depth--
+		case ",":
+			if depth == 0 {
+				args = append(args, cur)
+				cur = nil
+				continue
+			}
+		}
+		cur = append(cur, parts[i])
+	}
+	return 0, nil, ErrIncorrectPriorOp
+}
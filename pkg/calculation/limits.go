@@ -0,0 +1,61 @@
+package calculation
+
+import "strings"
+
+// Ограничения на размер выражения, которые проверяются до того, как оно попадёт в базу.
+// 0 - без ограничения.
+var (
+	MaxInputBytes = 16 << 10 // длина текста выражения в байтах
+	MaxTokens     = 4096     // чисел, имён, операций и скобок во всех инструкциях
+	MaxDepth      = 64       // вложенность скобок, в том числе в телах функций
+	MaxActions    = 10000    // действий после подстановки функций
+)
+
+// CheckInput проверяет длину текста выражения и число токенов в нём. Функции пользователя
+// для этого не нужны, поэтому слишком большое выражение можно отклонить, не обращаясь к базе.
+// Вложенность и число действий известны только после разбора и проверяются в Calc.
+func CheckInput(expression string) error {
+	if MaxInputBytes > 0 && len(expression) > MaxInputBytes {
+		return ErrInputTooLarge
+	}
+	if MaxTokens <= 0 {
+		return nil
+	}
+	tokens := 0
+	for _, statement := range strings.Split(expression, ";") {
+		name, body, isAssignment := strings.Cut(statement, "=")
+		if !isAssignment {
+			body = name
+		}
+		parts, err := tokenize(body)
+		if err != nil {
+			// Ошибку разбора вернёт Calc
+			return nil
+		}
+		tokens += len(parts)
+		if tokens > MaxTokens {
+			return ErrTooManyTokens
+		}
+	}
+	return nil
+}
+
+// checkDepth проверяет вложенность скобок одной инструкции
+func checkDepth(parts []string) error {
+	if MaxDepth <= 0 {
+		return nil
+	}
+	depth := 0
+	for _, part := range parts {
+		switch part {
+		case "(":
+			depth++
+			if depth > MaxDepth {
+				return ErrTooDeep
+			}
+		case ")":
+			depth--
+		}
+	}
+	return nil
+}
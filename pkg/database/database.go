@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
@@ -18,93 +20,133 @@ type User struct {
 }
 
 type Expression struct {
-	ID      int64    `json:"id,omitempty"`
-	UserID  int64    `json:"-"`
-	Status  string   `json:"status,omitempty"`
-	Result  float64  `json:"result,omitempty"`
-	Actions []Action `json:"-"`
+	ID          int64      `json:"id,omitempty"`
+	UserID      int64      `json:"-"`
+	Status      string     `json:"status,omitempty"`
+	Result      float64    `json:"result,omitempty"`
+	Expression  string     `json:"expression,omitempty"`
+	CallbackURL string     `json:"-"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ComputeMs   int64      `json:"computeMs,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	RunAt       *time.Time `json:"runAt,omitempty"`
+	ScheduleID  int64      `json:"scheduleID,omitempty"`
+	RerunOf     int64      `json:"rerunOf,omitempty"`
+	Actions     []Action   `json:"-"`
+	Variables   []Variable `json:"variables,omitempty"`
 }
 
 type Action struct {
-	ID           int64   `json:"id"`
-	ExpressionID int64   `json:"exprID"`
-	UserID       int64   `json:"userID"`
-	Arg1         float64 `json:"arg1"`
-	Arg2         float64 `json:"arg2"`
-	Result       float64 `json:"result"`
-	Operation    string  `json:"operation"`
-	IdDepends    []int64 `json:"idDepends"`
-	Completed    bool    `json:"completed"`
-	NowCalculate bool    `json:"nowCalculate"`
+	ID           int64      `json:"id"`
+	ExpressionID int64      `json:"exprID"`
+	UserID       int64      `json:"userID"`
+	Arg1         float64    `json:"arg1"`
+	Arg2         float64    `json:"arg2"`
+	Result       float64    `json:"result"`
+	Operation    string     `json:"operation"`
+	IdDepends    []int64    `json:"idDepends"`
+	Completed    bool       `json:"completed"`
+	NowCalculate bool       `json:"nowCalculate"`
+	Agent        string     `json:"agent,omitempty"`
+	StartedAt    *time.Time `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
 }
 
-func CreateTables(ctx context.Context, db *sql.DB) error {
-	const (
-		usersTable = `
-            CREATE TABLE IF NOT EXISTS users (
-                id INTEGER PRIMARY KEY AUTOINCREMENT,
-                username TEXT UNIQUE NOT NULL,
-                password TEXT NOT NULL
-            );`
-		expressionsTable = `
-            CREATE TABLE IF NOT EXISTS expressions (
-    			id INTEGER NOT NULL,
-    			user_id INTEGER NOT NULL,
-    			status TEXT,
-    			result REAL,
-    			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
-    			UNIQUE (user_id, id)
-			);`
-		actionsTable = `
-            CREATE TABLE IF NOT EXISTS actions (
-    			id INTEGER,
-    			expression_id INTEGER NOT NULL,
-    			user_id INTEGER,
-    			arg1 REAL,
-    			arg2 REAL,
-    			result REAL,
-    			operation TEXT,
-    			id_depends TEXT,
-    			completed BOOLEAN,
-    			now_calculate BOOLEAN,
-    			FOREIGN KEY (expression_id, user_id) REFERENCES expressions(id, user_id) ON DELETE CASCADE ON UPDATE CASCADE
-			);`
-	)
-
-	_, err := db.ExecContext(ctx, usersTable)
-	if err != nil {
-		return err
-	}
+// Variable - переменная скрипта. ActionID указывает на действие, которое её вычисляет, или равен -1 для числа
+type Variable struct {
+	Name      string  `json:"name"`
+	ActionID  int64   `json:"actionID"`
+	Value     float64 `json:"value"`
+	Completed bool    `json:"completed"`
+}
 
-	_, err = db.ExecContext(ctx, expressionsTable)
-	if err != nil {
-		return err
-	}
+type Function struct {
+	ID     int64    `json:"-"`
+	UserID int64    `json:"-"`
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+	Body   string   `json:"body"`
+}
 
-	_, err = db.ExecContext(ctx, actionsTable)
-	if err != nil {
-		return err
-	}
+// WebhookDelivery - одна попытка отправить результат выражения на callback_url
+type WebhookDelivery struct {
+	ID           int64     `json:"id"`
+	UserID       int64     `json:"-"`
+	ExpressionID int64     `json:"exprID"`
+	URL          string    `json:"url"`
+	Attempt      int       `json:"attempt"`
+	StatusCode   int       `json:"statusCode"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
 
-	return nil
+// PendingWebhook - результат выражения, который ещё не доставлен на URL. Attempt - сколько
+// попыток уже сделано, NextAttemptAt - когда делать следующую
+type PendingWebhook struct {
+	UserID        int64
+	ExpressionID  int64
+	URL           string
+	Attempt       int
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+// IdempotencyKey - запомненный ответ на POST /api/v1/calculate. ExpressionID равен 0,
+// пока первый запрос с этим ключом ещё выполняется
+type IdempotencyKey struct {
+	UserID       int64
+	Key          string
+	RequestHash  string
+	ExpressionID int64
+	StatusCode   int
+	CreatedAt    time.Time
+}
+
+// Schedule - повторяющееся выражение. Каждый запуск по расписанию Cron создаёт выражение
+// с ScheduleID, хранятся последние Keep запусков. У расписания на паузе NextRunAt равен nil
+type Schedule struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Expression string     `json:"expression"`
+	Cron       string     `json:"cron"`
+	Priority   int        `json:"priority,omitempty"`
+	Keep       int        `json:"keep"`
+	Paused     bool       `json:"paused"`
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+	LastRunAt  *time.Time `json:"lastRunAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// Quota - личные лимиты пользователя. nil - действует общий лимит
+type Quota struct {
+	UserID     int64    `json:"-"`
+	RPS        *float64 `json:"rps,omitempty"`
+	Burst      *int     `json:"burst,omitempty"`
+	MaxPending *int     `json:"maxPending,omitempty"`
+	MaxActions *int     `json:"maxActions,omitempty"`
+}
+
+// CreateTables приводит схему базы к последней версии, см. Migrate
+func CreateTables(ctx context.Context, db *sql.DB) error {
+	_, err := Migrate(ctx, db)
+	return err
 }
 
 func InsertUser(ctx context.Context, db *sql.DB, user *User) (int64, error) {
 	query := `
         INSERT INTO users (username, password) 
         VALUES ($1, $2)
+        RETURNING id
     `
 	cryptedPassword, err := CryptPassword(user.Password)
 	if err != nil {
 		return 0, err
 	}
 
-	result, err := db.ExecContext(ctx, query, user.Username, cryptedPassword)
-	if err != nil {
-		return 0, err
-	}
-
-	id, err := result.LastInsertId()
+	var id int64
+	err = db.QueryRowContext(ctx, query, user.Username, cryptedPassword).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
@@ -112,21 +154,33 @@ func InsertUser(ctx context.Context, db *sql.DB, user *User) (int64, error) {
 	return id, nil
 }
 
+// querier - общее у *sql.DB и *sql.Tx, чтобы вставки работали и внутри транзакции
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 func InsertExpression(ctx context.Context, db *sql.DB, userID int64, expr *Expression) (int64, error) {
-	query := "SELECT COALESCE(MAX(id), 0) FROM expressions WHERE user_id = $1"
-	var maxExprId int64
-	err := db.QueryRowContext(ctx, query, userID).Scan(&maxExprId)
-	if err != nil && err != sql.ErrNoRows {
+	return insertExpression(ctx, db, userID, expr)
+}
+
+func insertExpression(ctx context.Context, db querier, userID int64, expr *Expression) (int64, error) {
+	newExprId, err := nextExpressionID(ctx, db, userID)
+	if err != nil {
 		return 0, err
 	}
 
-	newExprId := maxExprId + 1
+	createdAt := time.Now()
+	if expr.CreatedAt != nil {
+		createdAt = *expr.CreatedAt
+	}
 
 	queryInsert := `
-        INSERT INTO expressions (id, user_id, status, result) 
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO expressions (id, user_id, status, result, expression, callback_url, created_at, started_at, completed_at, compute_ms, priority, run_at, schedule_id, rerun_of) 
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
     `
-	_, err = db.ExecContext(ctx, queryInsert, newExprId, userID, expr.Status, expr.Result)
+	_, err = db.ExecContext(ctx, queryInsert, newExprId, userID, expr.Status, expr.Result, expr.Expression, expr.CallbackURL,
+		toMillis(createdAt), ptrMillis(expr.StartedAt), ptrMillis(expr.CompletedAt), expr.ComputeMs, expr.Priority, ptrMillis(expr.RunAt), expr.ScheduleID, expr.RerunOf)
 	if err != nil {
 		return 0, err
 	}
@@ -134,32 +188,192 @@ func InsertExpression(ctx context.Context, db *sql.DB, userID int64, expr *Expre
 	return newExprId, nil
 }
 
-func InsertActions(ctx context.Context, db *sql.DB, exprId int64, userID int64, action *Action) (int64, error) {
-	query := "SELECT COALESCE(MAX(id), 0) FROM actions WHERE expression_id = $1 and user_id = $2"
-	var maxActionId int64
-	err := db.QueryRowContext(ctx, query, exprId, userID).Scan(&maxActionId)
-	if err != nil && err != sql.ErrNoRows {
-		return 0, err
+// nextExpressionID выдаёт следующий номер выражения пользователя из expression_sequences.
+// Внутри транзакции строка пользователя остаётся заблокированной до её конца,
+// поэтому параллельные вставки одного пользователя не получат одинаковый номер.
+func nextExpressionID(ctx context.Context, db querier, userID int64) (int64, error) {
+	query := `
+        INSERT INTO expression_sequences (user_id, last_id) VALUES ($1, 1)
+        ON CONFLICT (user_id) DO UPDATE SET last_id = expression_sequences.last_id + 1
+        RETURNING last_id
+    `
+	var id int64
+	err := db.QueryRowContext(ctx, query, userID).Scan(&id)
+	return id, err
+}
+
+// InsertExpressions сохраняет выражения вместе с их действиями и переменными в одной транзакции
+func InsertExpressions(ctx context.Context, db *sql.DB, userID int64, exprs []Expression) ([]int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	newActionId := maxActionId + 1
+	ids := make([]int64, 0, len(exprs))
+	for _, expr := range exprs {
+		exprID, err := insertExpression(ctx, tx, userID, &expr)
+		if err != nil {
+			return nil, err
+		}
+		if err := insertActionsBulk(ctx, tx, exprID, userID, expr.Actions); err != nil {
+			return nil, err
+		}
+		if err := insertVariablesBulk(ctx, tx, exprID, userID, expr.Variables); err != nil {
+			return nil, err
+		}
+		ids = append(ids, exprID)
+	}
 
-	idDependsJson, err := json.Marshal(action.IdDepends)
-	if err != nil {
-		return 0, err
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
+	return ids, nil
+}
 
-	queryInsert := `
-        INSERT INTO actions (expression_id, user_id, id, arg1, arg2, result, operation, id_depends, completed, now_calculate)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+// bulkRows - сколько строк вставляется одним INSERT, чтобы не упереться в лимит параметров SQLite
+const bulkRows = 500
+
+// insertActionsBulk вставляет все действия нового выражения несколькими INSERT.
+// Номера действий - их позиции в срезе, начиная с 1, как и в IdDepends.
+func insertActionsBulk(ctx context.Context, db querier, exprId int64, userID int64, actions []Action) error {
+	for start := 0; start < len(actions); start += bulkRows {
+		chunk := actions[start:min(start+bulkRows, len(actions))]
+		var values []string
+		var args []any
+		for i, a := range chunk {
+			idDependsJson, err := json.Marshal(a.IdDepends)
+			if err != nil {
+				return err
+			}
+			values = append(values, placeholders(len(args), 10))
+			args = append(args, exprId, userID, int64(start+i+1), a.Arg1, a.Arg2, a.Result, a.Operation, string(idDependsJson), a.Completed, a.NowCalculate)
+		}
+		query := "INSERT INTO actions (expression_id, user_id, id, arg1, arg2, result, operation, id_depends, completed, now_calculate) VALUES " +
+			strings.Join(values, ", ")
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertVariablesBulk(ctx context.Context, db querier, exprId int64, userID int64, vars []Variable) error {
+	for start := 0; start < len(vars); start += bulkRows {
+		chunk := vars[start:min(start+bulkRows, len(vars))]
+		var values []string
+		var args []any
+		for i, v := range chunk {
+			values = append(values, placeholders(len(args), 6))
+			args = append(args, int64(start+i+1), exprId, userID, v.Name, v.ActionID, v.Value)
+		}
+		query := "INSERT INTO variables (id, expression_id, user_id, name, action_id, value) VALUES " + strings.Join(values, ", ")
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeholders возвращает "($from+1, ..., $from+n)"
+func placeholders(from, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("$%d", from+i+1)
+	}
+	return "(" + strings.Join(p, ", ") + ")"
+}
+
+func InsertVariable(ctx context.Context, db *sql.DB, exprId int64, userID int64, id int64, v *Variable) error {
+	return insertVariable(ctx, db, exprId, userID, id, v)
+}
+
+func insertVariable(ctx context.Context, db querier, exprId int64, userID int64, id int64, v *Variable) error {
+	query := `
+        INSERT INTO variables (id, expression_id, user_id, name, action_id, value)
+        VALUES ($1, $2, $3, $4, $5, $6)
     `
-	_, err = db.ExecContext(ctx, queryInsert, exprId, userID, newActionId, action.Arg1, action.Arg2, action.Result, action.Operation, string(idDependsJson), action.Completed, action.NowCalculate)
+	_, err := db.ExecContext(ctx, query, id, exprId, userID, v.Name, v.ActionID, v.Value)
+	return err
+}
 
+// InsertFunction сохраняет функцию пользователя, заменяя прежнее определение с тем же именем
+func InsertFunction(ctx context.Context, db *sql.DB, userID int64, f *Function) error {
+	paramsJson, err := json.Marshal(f.Params)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return newActionId, nil
+	query := `
+        INSERT INTO functions (user_id, name, params, body)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, name) DO UPDATE SET params = excluded.params, body = excluded.body
+    `
+	_, err = db.ExecContext(ctx, query, userID, f.Name, string(paramsJson), f.Body)
+	return err
+}
+
+// InsertSchedule сохраняет новое расписание и возвращает его id
+func InsertSchedule(ctx context.Context, db *sql.DB, sc *Schedule) (int64, error) {
+	query := `
+        INSERT INTO schedules (user_id, expression, cron, priority, keep, paused, next_run_at, last_run_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        RETURNING id
+    `
+	var id int64
+	err := db.QueryRowContext(ctx, query, sc.UserID, sc.Expression, sc.Cron, sc.Priority, sc.Keep, sc.Paused,
+		ptrMillis(sc.NextRunAt), ptrMillis(sc.LastRunAt), toMillis(sc.CreatedAt)).Scan(&id)
+	return id, err
+}
+
+// InsertQuota сохраняет личные лимиты пользователя, заменяя прежние
+func InsertQuota(ctx context.Context, db *sql.DB, q *Quota) error {
+	query := `
+        INSERT INTO user_quotas (user_id, rps, burst, max_pending, max_actions)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id) DO UPDATE SET rps = excluded.rps, burst = excluded.burst,
+            max_pending = excluded.max_pending, max_actions = excluded.max_actions
+    `
+	_, err := db.ExecContext(ctx, query, q.UserID, q.RPS, q.Burst, q.MaxPending, q.MaxActions)
+	return err
+}
+
+func InsertWebhookDelivery(ctx context.Context, db *sql.DB, d *WebhookDelivery) (int64, error) {
+	query := `
+        INSERT INTO webhook_deliveries (user_id, expression_id, url, attempt, status_code, error, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `
+	var id int64
+	err := db.QueryRowContext(ctx, query, d.UserID, d.ExpressionID, d.URL, d.Attempt, d.StatusCode, d.Error, toMillis(d.CreatedAt)).Scan(&id)
+	return id, err
+}
+
+// InsertPendingWebhook ставит доставку результата выражения в очередь. Повторная постановка
+// того же выражения ничего не делает.
+func InsertPendingWebhook(ctx context.Context, db *sql.DB, p *PendingWebhook) error {
+	query := `
+        INSERT INTO webhook_queue (user_id, expression_id, url, attempt, next_attempt_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (user_id, expression_id) DO NOTHING
+    `
+	_, err := db.ExecContext(ctx, query, p.UserID, p.ExpressionID, p.URL, p.Attempt, toMillis(p.NextAttemptAt), toMillis(p.CreatedAt))
+	return err
+}
+
+// InsertIdempotencyKey резервирует ключ и возвращает false, если он уже занят
+func InsertIdempotencyKey(ctx context.Context, db *sql.DB, k *IdempotencyKey) (bool, error) {
+	query := `
+        INSERT INTO idempotency_keys (user_id, key, request_hash, created_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, key) DO NOTHING
+    `
+	res, err := db.ExecContext(ctx, query, k.UserID, k.Key, k.RequestHash, toMillis(k.CreatedAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
 func SelectUsers(ctx context.Context, db *sql.DB) ([]User, error) {
@@ -222,9 +436,25 @@ func SelectExpressions(ctx context.Context, db *sql.DB, userID int64) ([]Express
 	return exprs, nil
 }
 
+const expressionColumns = "id, user_id, status, result, expression, callback_url, created_at, started_at, completed_at, compute_ms, priority, run_at, schedule_id, rerun_of"
+
+func scanExpression(rows *sql.Rows) (Expression, error) {
+	e := Expression{}
+	var createdAt, startedAt, completedAt, runAt int64
+	err := rows.Scan(&e.ID, &e.UserID, &e.Status, &e.Result, &e.Expression, &e.CallbackURL, &createdAt, &startedAt, &completedAt, &e.ComputeMs, &e.Priority, &runAt, &e.ScheduleID, &e.RerunOf)
+	if err != nil {
+		return Expression{}, err
+	}
+	e.CreatedAt = fromMillis(createdAt)
+	e.StartedAt = fromMillis(startedAt)
+	e.CompletedAt = fromMillis(completedAt)
+	e.RunAt = fromMillis(runAt)
+	return e, nil
+}
+
 func SelectExpression(ctx context.Context, db *sql.DB, userID int64, exprID int64) ([]Expression, error) {
 	var exprs []Expression
-	var q = "SELECT id, user_id, status, result FROM expressions WHERE user_id = $1 AND id = $2"
+	var q = "SELECT " + expressionColumns + " FROM expressions WHERE user_id = $1 AND id = $2"
 	rows, err := db.QueryContext(ctx, q, userID, exprID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
@@ -232,8 +462,7 @@ func SelectExpression(ctx context.Context, db *sql.DB, userID int64, exprID int6
 	defer rows.Close()
 
 	for rows.Next() {
-		e := Expression{}
-		err := rows.Scan(&e.ID, &e.UserID, &e.Status, &e.Result)
+		e, err := scanExpression(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -243,9 +472,168 @@ func SelectExpression(ctx context.Context, db *sql.DB, userID int64, exprID int6
 	return exprs, nil
 }
 
+// ExpressionFilter - условия выборки страницы выражений. Статусы из Statuses отбираются,
+// из ExceptStatuses - отбрасываются; нулевое время означает отсутствие границы.
+// Страница начинается после строки с ключом сортировки AfterKey и id AfterID, если AfterID не 0
+type ExpressionFilter struct {
+	Statuses       []string
+	ExceptStatuses []string
+	CreatedFrom    time.Time
+	CreatedTo      time.Time
+	ScheduleID     int64
+	RerunOf        int64
+	SortBy         string
+	Desc           bool
+	AfterKey       int64
+	AfterID        int64
+	Limit          int
+}
+
+var sortColumns = map[string]string{
+	"id":        "id",
+	"created":   "created_at",
+	"completed": "completed_at",
+}
+
+// SortKey возвращает значение, по которому выражение упорядочено при сортировке sortBy
+func (e Expression) SortKey(sortBy string) int64 {
+	switch sortBy {
+	case "created":
+		return ptrMillis(e.CreatedAt)
+	case "completed":
+		return ptrMillis(e.CompletedAt)
+	}
+	return e.ID
+}
+
+func (f ExpressionFilter) where(userID int64) (string, []any) {
+	conds := []string{"user_id = $1"}
+	args := []any{userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	list := func(values []string) string {
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = arg(v)
+		}
+		return strings.Join(placeholders, ", ")
+	}
+
+	if len(f.Statuses) > 0 {
+		conds = append(conds, "status IN ("+list(f.Statuses)+")")
+	}
+	if len(f.ExceptStatuses) > 0 {
+		conds = append(conds, "status NOT IN ("+list(f.ExceptStatuses)+")")
+	}
+	if !f.CreatedFrom.IsZero() {
+		conds = append(conds, "created_at >= "+arg(f.CreatedFrom.UnixMilli()))
+	}
+	if !f.CreatedTo.IsZero() {
+		conds = append(conds, "created_at < "+arg(f.CreatedTo.UnixMilli()))
+	}
+	if f.ScheduleID != 0 {
+		conds = append(conds, "schedule_id = "+arg(f.ScheduleID))
+	}
+	if f.RerunOf != 0 {
+		conds = append(conds, "rerun_of = "+arg(f.RerunOf))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// SelectExpressionsPage возвращает не больше f.Limit выражений пользователя, отсортированных по
+// f.SortBy и затем по id. Курсор сравнивается парой (ключ, id), поэтому страницы не пересекаются
+func SelectExpressionsPage(ctx context.Context, db *sql.DB, userID int64, f ExpressionFilter) ([]Expression, error) {
+	column, ok := sortColumns[f.SortBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", f.SortBy)
+	}
+	order, cmp := "ASC", ">"
+	if f.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	where, args := f.where(userID)
+	if f.AfterID != 0 {
+		if column == "id" {
+			where += fmt.Sprintf(" AND id %s $%d", cmp, len(args)+1)
+			args = append(args, f.AfterID)
+		} else {
+			where += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, cmp, len(args)+1, len(args)+2)
+			args = append(args, f.AfterKey, f.AfterID)
+		}
+	}
+
+	q := "SELECT " + expressionColumns + " FROM expressions WHERE " + where
+	if column == "id" {
+		q += " ORDER BY id " + order
+	} else {
+		q += fmt.Sprintf(" ORDER BY %s %s, id %s", column, order, order)
+	}
+	q += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	args = append(args, f.Limit)
+
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exprs := []Expression{}
+	for rows.Next() {
+		e, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	return exprs, rows.Err()
+}
+
+// SelectExpressionsByStatus возвращает выражения всех пользователей с указанным статусом
+func SelectExpressionsByStatus(ctx context.Context, db *sql.DB, status string) ([]Expression, error) {
+	q := "SELECT " + expressionColumns + " FROM expressions WHERE status = $1 ORDER BY user_id, id"
+	rows, err := db.QueryContext(ctx, q, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exprs []Expression
+	for rows.Next() {
+		e, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	return exprs, rows.Err()
+}
+
+// SelectNextRunAt возвращает ближайшее время запуска отложенных выражений или nil, если их нет
+func SelectNextRunAt(ctx context.Context, db *sql.DB) (*time.Time, error) {
+	var runAt sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MIN(run_at) FROM expressions WHERE status = 'scheduled'").Scan(&runAt)
+	if err != nil {
+		return nil, err
+	}
+	return fromMillis(runAt.Int64), nil
+}
+
+// CountExpressions считает выражения пользователя, подходящие под фильтр, без учёта курсора и лимита
+func CountExpressions(ctx context.Context, db *sql.DB, userID int64, f ExpressionFilter) (int64, error) {
+	where, args := f.where(userID)
+	var n int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM expressions WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
 func SelectActions(ctx context.Context, db *sql.DB, userID int64, exprID int64) ([]Action, error) {
 	var actions []Action
-	var q = "SELECT id, expression_id, user_id, arg1, arg2, result, operation, id_depends, completed, now_calculate FROM actions WHERE user_id = $1 AND expression_id = $2"
+	var q = "SELECT id, expression_id, user_id, arg1, arg2, result, operation, id_depends, completed, now_calculate, agent, started_at, finished_at FROM actions WHERE user_id = $1 AND expression_id = $2 ORDER BY id"
 	rows, err := db.QueryContext(ctx, q, userID, exprID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
@@ -255,11 +643,14 @@ func SelectActions(ctx context.Context, db *sql.DB, userID int64, exprID int64)
 	for rows.Next() {
 		a := Action{}
 		s := ""
-		err := rows.Scan(&a.ID, &a.ExpressionID, &a.UserID, &a.Arg1, &a.Arg2, &a.Result, &a.Operation, &s, &a.Completed, &a.NowCalculate)
+		var startedAt, finishedAt int64
+		err := rows.Scan(&a.ID, &a.ExpressionID, &a.UserID, &a.Arg1, &a.Arg2, &a.Result, &a.Operation, &s, &a.Completed, &a.NowCalculate, &a.Agent, &startedAt, &finishedAt)
 
 		if err != nil {
 			return nil, err
 		}
+		a.StartedAt = fromMillis(startedAt)
+		a.FinishedAt = fromMillis(finishedAt)
 
 		sReader := strings.NewReader(s)
 		err = json.NewDecoder(sReader).Decode(&a.IdDepends)
@@ -273,6 +664,199 @@ func SelectActions(ctx context.Context, db *sql.DB, userID int64, exprID int64)
 	return actions, nil
 }
 
+func SelectVariables(ctx context.Context, db *sql.DB, userID int64, exprID int64) ([]Variable, error) {
+	var vars []Variable
+	var q = `
+        SELECT v.name, v.action_id, COALESCE(a.result, v.value), COALESCE(a.completed, TRUE)
+        FROM variables v
+        LEFT JOIN actions a ON a.user_id = v.user_id AND a.expression_id = v.expression_id AND a.id = v.action_id
+        WHERE v.user_id = $1 AND v.expression_id = $2
+        ORDER BY v.id
+    `
+	rows, err := db.QueryContext(ctx, q, userID, exprID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v := Variable{}
+		if err := rows.Scan(&v.Name, &v.ActionID, &v.Value, &v.Completed); err != nil {
+			return nil, err
+		}
+		vars = append(vars, v)
+	}
+
+	return vars, rows.Err()
+}
+
+func SelectFunctions(ctx context.Context, db *sql.DB, userID int64) ([]Function, error) {
+	var funcs []Function
+	var q = "SELECT id, user_id, name, params, body FROM functions WHERE user_id = $1 ORDER BY name"
+	rows, err := db.QueryContext(ctx, q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := Function{}
+		params := ""
+		if err := rows.Scan(&f.ID, &f.UserID, &f.Name, &params, &f.Body); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(params), &f.Params); err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, f)
+	}
+
+	return funcs, rows.Err()
+}
+
+func SelectWebhookDeliveries(ctx context.Context, db *sql.DB, userID int64, exprID int64) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	var q = "SELECT id, user_id, expression_id, url, attempt, status_code, error, created_at FROM webhook_deliveries WHERE user_id = $1 AND expression_id = $2 ORDER BY id"
+	rows, err := db.QueryContext(ctx, q, userID, exprID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := WebhookDelivery{}
+		var createdAt int64
+		if err := rows.Scan(&d.ID, &d.UserID, &d.ExpressionID, &d.URL, &d.Attempt, &d.StatusCode, &d.Error, &createdAt); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.UnixMilli(createdAt)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// SelectDueWebhooks возвращает доставки всех пользователей, время попытки которых наступило к now
+func SelectDueWebhooks(ctx context.Context, db *sql.DB, now time.Time) ([]PendingWebhook, error) {
+	var q = "SELECT user_id, expression_id, url, attempt, next_attempt_at, created_at FROM webhook_queue WHERE next_attempt_at <= $1 ORDER BY next_attempt_at"
+	rows, err := db.QueryContext(ctx, q, toMillis(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []PendingWebhook
+	for rows.Next() {
+		p := PendingWebhook{}
+		var nextAttemptAt, createdAt int64
+		if err := rows.Scan(&p.UserID, &p.ExpressionID, &p.URL, &p.Attempt, &nextAttemptAt, &createdAt); err != nil {
+			return nil, err
+		}
+		p.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+		p.CreatedAt = time.UnixMilli(createdAt)
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// SelectNextWebhookAttempt возвращает время ближайшей попытки доставки или nil, если очередь пуста
+func SelectNextWebhookAttempt(ctx context.Context, db *sql.DB) (*time.Time, error) {
+	var next sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MIN(next_attempt_at) FROM webhook_queue").Scan(&next)
+	if err != nil {
+		return nil, err
+	}
+	return fromMillis(next.Int64), nil
+}
+
+func SelectIdempotencyKey(ctx context.Context, db *sql.DB, userID int64, key string) (IdempotencyKey, error) {
+	k := IdempotencyKey{}
+	var createdAt int64
+	var q = "SELECT user_id, key, request_hash, expression_id, status_code, created_at FROM idempotency_keys WHERE user_id = $1 AND key = $2"
+	err := db.QueryRowContext(ctx, q, userID, key).Scan(&k.UserID, &k.Key, &k.RequestHash, &k.ExpressionID, &k.StatusCode, &createdAt)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	k.CreatedAt = time.UnixMilli(createdAt)
+	return k, nil
+}
+
+const scheduleColumns = "id, user_id, expression, cron, priority, keep, paused, next_run_at, last_run_at, created_at"
+
+func scanSchedule(row interface{ Scan(...any) error }) (Schedule, error) {
+	sc := Schedule{}
+	var nextRunAt, lastRunAt, createdAt int64
+	err := row.Scan(&sc.ID, &sc.UserID, &sc.Expression, &sc.Cron, &sc.Priority, &sc.Keep, &sc.Paused, &nextRunAt, &lastRunAt, &createdAt)
+	if err != nil {
+		return Schedule{}, err
+	}
+	sc.NextRunAt = fromMillis(nextRunAt)
+	sc.LastRunAt = fromMillis(lastRunAt)
+	sc.CreatedAt = time.UnixMilli(createdAt)
+	return sc, nil
+}
+
+func selectSchedules(ctx context.Context, db *sql.DB, where string, args ...any) ([]Schedule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+scheduleColumns+" FROM schedules WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules, rows.Err()
+}
+
+func SelectSchedules(ctx context.Context, db *sql.DB, userID int64) ([]Schedule, error) {
+	return selectSchedules(ctx, db, "user_id = $1", userID)
+}
+
+// SelectSchedule возвращает расписание пользователя или sql.ErrNoRows
+func SelectSchedule(ctx context.Context, db *sql.DB, userID, id int64) (Schedule, error) {
+	q := "SELECT " + scheduleColumns + " FROM schedules WHERE user_id = $1 AND id = $2"
+	return scanSchedule(db.QueryRowContext(ctx, q, userID, id))
+}
+
+// SelectDueSchedules возвращает расписания всех пользователей, не стоящие на паузе,
+// время запуска которых наступило к now
+func SelectDueSchedules(ctx context.Context, db *sql.DB, now time.Time) ([]Schedule, error) {
+	return selectSchedules(ctx, db, "paused = FALSE AND next_run_at > 0 AND next_run_at <= $1", toMillis(now))
+}
+
+// SelectNextScheduleRun возвращает ближайшее время запуска по расписаниям или nil, если их нет
+func SelectNextScheduleRun(ctx context.Context, db *sql.DB) (*time.Time, error) {
+	var next sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MIN(next_run_at) FROM schedules WHERE paused = FALSE AND next_run_at > 0").Scan(&next)
+	if err != nil {
+		return nil, err
+	}
+	return fromMillis(next.Int64), nil
+}
+
+// SelectQuota возвращает личные лимиты пользователя; если их нет, все поля равны nil
+func SelectQuota(ctx context.Context, db *sql.DB, userID int64) (Quota, error) {
+	q := Quota{UserID: userID}
+	var query = "SELECT rps, burst, max_pending, max_actions FROM user_quotas WHERE user_id = $1"
+	err := db.QueryRowContext(ctx, query, userID).Scan(&q.RPS, &q.Burst, &q.MaxPending, &q.MaxActions)
+	if err == sql.ErrNoRows {
+		return q, nil
+	}
+	return q, err
+}
+
+func DeleteQuota(ctx context.Context, db *sql.DB, userID int64) error {
+	var q = "DELETE FROM user_quotas WHERE user_id = $1"
+	_, err := db.ExecContext(ctx, q, userID)
+	return err
+}
+
 func UpdateUser(ctx context.Context, db *sql.DB, userID int64, user *User) error {
 	var q = "UPDATE users SET username = $1, password = $2 WHERE id = $3"
 
@@ -289,14 +873,82 @@ func UpdateUser(ctx context.Context, db *sql.DB, userID int64, user *User) error
 }
 
 func UpdateExpression(ctx context.Context, db *sql.DB, userID, exprID int64, expr *Expression) error {
-	var q = "UPDATE expressions SET status = $1, result = $2 WHERE user_id = $3 AND id = $4"
-	_, err := db.ExecContext(ctx, q, expr.Status, expr.Result, userID, exprID)
+	var q = "UPDATE expressions SET status = $1, result = $2, completed_at = $3, compute_ms = $4 WHERE user_id = $5 AND id = $6"
+	_, err := db.ExecContext(ctx, q, expr.Status, expr.Result, ptrMillis(expr.CompletedAt), expr.ComputeMs, userID, exprID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// UpdateSchedule сохраняет паузу и время следующего запуска расписания
+func UpdateSchedule(ctx context.Context, db *sql.DB, sc *Schedule) error {
+	var q = "UPDATE schedules SET paused = $1, next_run_at = $2 WHERE user_id = $3 AND id = $4"
+	_, err := db.ExecContext(ctx, q, sc.Paused, ptrMillis(sc.NextRunAt), sc.UserID, sc.ID)
+	return err
+}
+
+// ClaimScheduleRun отмечает запуск расписания, назначенный на runAt, и переносит следующий
+// запуск на next. Возвращает false, если запуск уже отмечен или расписание поставлено на паузу
+func ClaimScheduleRun(ctx context.Context, db *sql.DB, userID, id int64, runAt, next time.Time) (bool, error) {
+	var q = "UPDATE schedules SET last_run_at = $1, next_run_at = $2 WHERE user_id = $3 AND id = $4 AND next_run_at = $5 AND paused = FALSE"
+	res, err := db.ExecContext(ctx, q, toMillis(runAt), toMillis(next), userID, id, toMillis(runAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimPendingWebhook забирает попытку доставки, назначенную на at, переносом next_attempt_at
+// на until. Возвращает false, если попытку уже забрали.
+func ClaimPendingWebhook(ctx context.Context, db *sql.DB, userID, exprID int64, at, until time.Time) (bool, error) {
+	var q = "UPDATE webhook_queue SET next_attempt_at = $1 WHERE user_id = $2 AND expression_id = $3 AND next_attempt_at = $4"
+	res, err := db.ExecContext(ctx, q, toMillis(until), userID, exprID, toMillis(at))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdatePendingWebhook сохраняет число сделанных попыток и время следующей
+func UpdatePendingWebhook(ctx context.Context, db *sql.DB, p *PendingWebhook) error {
+	var q = "UPDATE webhook_queue SET attempt = $1, next_attempt_at = $2 WHERE user_id = $3 AND expression_id = $4"
+	_, err := db.ExecContext(ctx, q, p.Attempt, toMillis(p.NextAttemptAt), p.UserID, p.ExpressionID)
+	return err
+}
+
+// PromoteExpressions переводит отложенные выражения, время которых наступило к now, в статус
+// "under consideration" и возвращает их. Выражение переводится ровно один раз, даже если
+// вызовы идут параллельно.
+func PromoteExpressions(ctx context.Context, db *sql.DB, now time.Time) ([]Expression, error) {
+	q := "UPDATE expressions SET status = 'under consideration' WHERE status = 'scheduled' AND run_at <= $1 RETURNING " + expressionColumns
+	rows, err := db.QueryContext(ctx, q, toMillis(now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exprs []Expression
+	for rows.Next() {
+		e, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+
+	return exprs, rows.Err()
+}
+
+// UpdateExpressionStarted запоминает, когда вычислитель взял первое действие выражения
+func UpdateExpressionStarted(ctx context.Context, db *sql.DB, userID, exprID int64, startedAt time.Time) error {
+	var q = "UPDATE expressions SET started_at = $1 WHERE user_id = $2 AND id = $3 AND started_at = 0"
+	_, err := db.ExecContext(ctx, q, toMillis(startedAt), userID, exprID)
+	return err
+}
+
 func UpdateAction(ctx context.Context, db *sql.DB, userID, exprID, actionID int64, action *Action) error {
 	var q = "UPDATE actions SET arg1 = $1, arg2 = $2, result = $3, operation = $4, id_depends = $5, completed = $6, now_calculate = $7 WHERE user_id = $8 AND expression_id = $9 AND id = $10"
 
@@ -305,7 +957,7 @@ func UpdateAction(ctx context.Context, db *sql.DB, userID, exprID, actionID int6
 		return err
 	}
 
-	_, err = db.ExecContext(ctx, q, action.Arg1, action.Arg2, action.Result, action.Operation, idDependsJson, action.Completed, action.NowCalculate, userID, exprID, actionID)
+	_, err = db.ExecContext(ctx, q, action.Arg1, action.Arg2, action.Result, action.Operation, string(idDependsJson), action.Completed, action.NowCalculate, userID, exprID, actionID)
 	if err != nil {
 		return err
 	}
@@ -324,6 +976,107 @@ func UpdateActionResult(ctx context.Context, db *sql.DB, userID, exprID, actionI
 	return err
 }
 
+func UpdateActionStarted(ctx context.Context, db *sql.DB, userID, exprID, actionID int64, agent string, startedAt time.Time) error {
+	var q = "UPDATE actions SET agent = $1, started_at = $2 WHERE user_id = $3 AND expression_id = $4 AND id = $5"
+	_, err := db.ExecContext(ctx, q, agent, toMillis(startedAt), userID, exprID, actionID)
+	return err
+}
+
+// ClaimAction отдаёт действие вычислителю, только если его ещё никто не взял и оно не посчитано.
+// Проверка и запись - один UPDATE, поэтому два вычислителя не получат одно действие.
+func ClaimAction(ctx context.Context, db *sql.DB, userID, exprID, actionID int64, agent string, startedAt time.Time) (bool, error) {
+	var q = `
+        UPDATE actions SET now_calculate = TRUE, agent = $1, started_at = $2
+        WHERE user_id = $3 AND expression_id = $4 AND id = $5 AND now_calculate = FALSE AND completed = FALSE
+    `
+	res, err := db.ExecContext(ctx, q, agent, toMillis(startedAt), userID, exprID, actionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseActions возвращает в очередь действия выражения, которые были выданы вычислителям,
+// но так и не посчитаны, и возвращает их количество
+func ReleaseActions(ctx context.Context, db *sql.DB, userID, exprID int64) (int64, error) {
+	var q = `
+        UPDATE actions SET now_calculate = FALSE, agent = '', started_at = 0
+        WHERE user_id = $1 AND expression_id = $2 AND now_calculate = TRUE AND completed = FALSE
+    `
+	res, err := db.ExecContext(ctx, q, userID, exprID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateActions записывает состояние нескольких действий одной транзакцией
+func UpdateActions(ctx context.Context, db *sql.DB, actions []Action) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        UPDATE actions SET result = $1, completed = $2, now_calculate = $3, agent = $4, started_at = $5, finished_at = $6
+        WHERE user_id = $7 AND expression_id = $8 AND id = $9
+    `)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, a := range actions {
+		_, err := stmt.ExecContext(ctx, a.Result, a.Completed, a.NowCalculate, a.Agent, ptrMillis(a.StartedAt), ptrMillis(a.FinishedAt),
+			a.UserID, a.ExpressionID, a.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func UpdateActionFinished(ctx context.Context, db *sql.DB, userID, exprID, actionID int64, finishedAt time.Time) error {
+	var q = "UPDATE actions SET finished_at = $1 WHERE user_id = $2 AND expression_id = $3 AND id = $4"
+	_, err := db.ExecContext(ctx, q, toMillis(finishedAt), userID, exprID, actionID)
+	return err
+}
+
+func UpdateIdempotencyKey(ctx context.Context, db *sql.DB, userID int64, key string, exprID int64, statusCode int) error {
+	var q = "UPDATE idempotency_keys SET expression_id = $1, status_code = $2 WHERE user_id = $3 AND key = $4"
+	_, err := db.ExecContext(ctx, q, exprID, statusCode, userID, key)
+	return err
+}
+
+// ReclaimIdempotencyKey отдаёт ключ новому запросу k, если первый запрос занял его раньше
+// staleBefore и так и не записал ответ. Возвращает false, если ответ записан или ключ уже
+// забрал другой запрос.
+func ReclaimIdempotencyKey(ctx context.Context, db *sql.DB, k *IdempotencyKey, staleBefore time.Time) (bool, error) {
+	var q = "UPDATE idempotency_keys SET request_hash = $1, created_at = $2 WHERE user_id = $3 AND key = $4 AND expression_id = 0 AND created_at < $5"
+	res, err := db.ExecContext(ctx, q, k.RequestHash, toMillis(k.CreatedAt), k.UserID, k.Key, toMillis(staleBefore))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func DeleteIdempotencyKey(ctx context.Context, db *sql.DB, userID int64, key string) error {
+	var q = "DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2"
+	_, err := db.ExecContext(ctx, q, userID, key)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys удаляет ключи пользователя, созданные раньше before
+func DeleteExpiredIdempotencyKeys(ctx context.Context, db *sql.DB, userID int64, before time.Time) error {
+	var q = "DELETE FROM idempotency_keys WHERE user_id = $1 AND created_at < $2"
+	_, err := db.ExecContext(ctx, q, userID, toMillis(before))
+	return err
+}
+
 func DeleteActions(ctx context.Context, db *sql.DB, userID, exprID int64) {
 	var q = "DELETE FROM actions WHERE user_id = $1 AND expression_id = $2"
 	db.ExecContext(ctx, q, userID, exprID)
@@ -334,9 +1087,76 @@ func DeleteExpressions(ctx context.Context, db *sql.DB, userID int64) {
 	db.ExecContext(ctx, q, userID)
 }
 
-func DeleteUser(ctx context.Context, db *sql.DB, userID int64) {
+func DeleteFunction(ctx context.Context, db *sql.DB, userID int64, name string) (bool, error) {
+	var q = "DELETE FROM functions WHERE user_id = $1 AND name = $2"
+	res, err := db.ExecContext(ctx, q, userID, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeletePendingWebhook убирает доставку из очереди: результат доставлен или попытки кончились
+func DeletePendingWebhook(ctx context.Context, db *sql.DB, userID, exprID int64) error {
+	var q = "DELETE FROM webhook_queue WHERE user_id = $1 AND expression_id = $2"
+	_, err := db.ExecContext(ctx, q, userID, exprID)
+	return err
+}
+
+// DeleteSchedule удаляет расписание; созданные им выражения остаются
+func DeleteSchedule(ctx context.Context, db *sql.DB, userID, id int64) (bool, error) {
+	var q = "DELETE FROM schedules WHERE user_id = $1 AND id = $2"
+	res, err := db.ExecContext(ctx, q, userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteScheduleRuns удаляет законченные запуски расписания, кроме keep последних.
+// Невычисленные запуски не удаляются, даже если они старше
+func DeleteScheduleRuns(ctx context.Context, db *sql.DB, userID, scheduleID int64, keep int) (int64, error) {
+	var q = `
+        DELETE FROM expressions
+        WHERE user_id = $1 AND schedule_id = $2 AND status NOT IN ('under consideration', 'scheduled')
+        AND id NOT IN (SELECT id FROM expressions WHERE user_id = $1 AND schedule_id = $2 ORDER BY id DESC LIMIT $3)
+    `
+	res, err := db.ExecContext(ctx, q, userID, scheduleID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteUser удаляет пользователя; его выражения, действия и остальное удаляются каскадно
+func DeleteUser(ctx context.Context, db *sql.DB, userID int64) error {
 	var q = "DELETE FROM users WHERE id = $1"
-	db.ExecContext(ctx, q, userID)
+	_, err := db.ExecContext(ctx, q, userID)
+	return err
+}
+
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func ptrMillis(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return toMillis(*t)
+}
+
+func fromMillis(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.UnixMilli(ms)
+	return &t
 }
 
 func CryptPassword(s string) (string, error) {
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDB(t *testing.T) {
@@ -52,3 +53,140 @@ func TestDB(t *testing.T) {
 	db.Close()
 	os.Remove("test.db")
 }
+
+func TestUpgradeTables(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Таблицы в том виде, в каком их создавали первые версии
+	for _, q := range []string{
+		"CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE NOT NULL, password TEXT NOT NULL)",
+		"CREATE TABLE expressions (id INTEGER NOT NULL, user_id INTEGER NOT NULL, status TEXT, result REAL, UNIQUE (user_id, id))",
+		"CREATE TABLE actions (id INTEGER, expression_id INTEGER NOT NULL, user_id INTEGER, arg1 REAL, arg2 REAL, result REAL, operation TEXT, id_depends TEXT, completed BOOLEAN, now_calculate BOOLEAN)",
+		"INSERT INTO users (username, password) VALUES ('old', 'hash')",
+		"INSERT INTO expressions (id, user_id, status, result) VALUES (1, 1, 'completed', 42)",
+		"INSERT INTO actions VALUES (1, 1, 1, 40, 2, 42, '+', '[-1,-1]', TRUE, FALSE)",
+	} {
+		if _, err := db.ExecContext(context.TODO(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateTables(context.TODO(), db); err != nil {
+		t.Fatalf("cannot upgrade tables: %v", err)
+	}
+
+	exprs, err := SelectExpression(context.TODO(), db, 1, 1)
+	if err != nil || len(exprs) != 1 {
+		t.Fatalf("cannot select old expression: %v", err)
+	}
+	if e := exprs[0]; e.Status != "completed" || e.Result != 42 || e.Expression != "" || e.CreatedAt != nil || e.ComputeMs != 0 {
+		t.Fatalf("unexpected old expression: %+v", e)
+	}
+	if actions, err := SelectActions(context.TODO(), db, 1, 1); err != nil || len(actions) != 1 || actions[0].Result != 42 {
+		t.Fatalf("unexpected old actions: %+v %v", actions, err)
+	}
+
+	created := time.Now()
+	id, err := InsertExpression(context.TODO(), db, 1, &Expression{Status: "under consideration", Expression: "1+1", CreatedAt: &created})
+	if err != nil || id != 2 {
+		t.Fatalf("cannot insert expression after upgrade: %d %v", id, err)
+	}
+	if exprs, _ := SelectExpression(context.TODO(), db, 1, 2); len(exprs) != 1 || exprs[0].Expression != "1+1" || exprs[0].CreatedAt.UnixMilli() != created.UnixMilli() {
+		t.Fatalf("unexpected new expression: %+v", exprs)
+	}
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", t.TempDir()+"/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	db := openTestDB(t)
+
+	migrations, err := Migrations(SQLite)
+	if err != nil || len(migrations) == 0 {
+		t.Fatalf("cannot load migrations: %v", err)
+	}
+
+	applied, err := Migrate(context.TODO(), db)
+	if err != nil || len(applied) != len(migrations) {
+		t.Fatalf("want %d applied migrations, have %d: %v", len(migrations), len(applied), err)
+	}
+
+	// Повторный запуск ничего не делает
+	if applied, err := Migrate(context.TODO(), db); err != nil || len(applied) != 0 {
+		t.Fatalf("unexpected second migrate: %v %v", applied, err)
+	}
+
+	statuses, err := SelectMigrationStatus(context.TODO(), db)
+	if err != nil || len(statuses) != len(migrations) {
+		t.Fatalf("unexpected status: %v %v", statuses, err)
+	}
+	for _, st := range statuses {
+		if st.AppliedAt == nil {
+			t.Errorf("migration %d is not applied", st.Version)
+		}
+	}
+
+	if _, err := InsertUser(context.TODO(), db, &User{Username: "abcd", Password: "1234"}); err != nil {
+		t.Fatalf("cannot insert user after migrate: %v", err)
+	}
+
+	// База, которую мигрировала более новая версия, не трогается
+	if _, err := db.ExecContext(context.TODO(), "INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(context.TODO(), db); err == nil {
+		t.Fatalf("want error for newer schema")
+	}
+}
+
+func TestMigrateCreateTablesDB(t *testing.T) {
+	db := openTestDB(t)
+
+	// Схема, созданная CreateTables до миграций, совпадает с первой миграцией, но без schema_migrations
+	migrations, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(context.TODO(), migrations[0].SQL); err != nil {
+		t.Fatal(err)
+	}
+	userID, err := InsertUser(context.TODO(), db, &User{Username: "abcd", Password: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Старая версия выдавала номера через MAX(id) + 1, без expression_sequences
+	q := "INSERT INTO expressions (id, user_id, status, result, expression) VALUES (1, $1, 'completed', 4, '2+2')"
+	if _, err := db.ExecContext(context.TODO(), q, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Migrate(context.TODO(), db); err != nil {
+		t.Fatalf("cannot migrate: %v", err)
+	}
+
+	// Последовательность продолжается с уже выданных номеров
+	if id, err := InsertExpression(context.TODO(), db, userID, &Expression{Status: "under consideration"}); err != nil || id != 2 {
+		t.Fatalf("unexpected id after migrate: %d %v", id, err)
+	}
+
+	exprs, err := SelectExpression(context.TODO(), db, userID, 1)
+	if err != nil || len(exprs) != 1 || exprs[0].Expression != "2+2" || exprs[0].Result != 4 {
+		t.Fatalf("unexpected expression after migrate: %+v %v", exprs, err)
+	}
+	statuses, _ := SelectMigrationStatus(context.TODO(), db)
+	if len(statuses) == 0 || statuses[0].AppliedAt == nil {
+		t.Fatalf("baseline is not recorded: %+v", statuses)
+	}
+}
@@ -0,0 +1,973 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errUsernameTaken     = errors.New("username is taken")
+	errUnknownUser       = errors.New("unknown user")
+	errUnknownExpression = errors.New("unknown expression")
+)
+
+// MemoryStore - Store в памяти процесса для тестов и запусков без сохранения данных.
+// Повторяет поведение SQL реализации: номера выражений и действий свои у каждого
+// пользователя и выражения, удаление пользователя удаляет всё его, время хранится
+// с точностью до миллисекунды. Все методы выполняются под одной блокировкой.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users      map[int64]*User
+	usernames  map[string]int64
+	lastUserID int64
+
+	exprs        map[int64]map[int64]*memExpression
+	exprSeqs     map[int64]int64
+	functions    map[int64]map[string]Function
+	lastFuncID   int64
+	deliveries   []WebhookDelivery
+	lastDelivery int64
+	webhooks     map[[2]int64]PendingWebhook // по пользователю и выражению
+	idempotency  map[int64]map[string]IdempotencyKey
+	quotas       map[int64]Quota
+	schedules    map[int64]Schedule
+	lastSchedule int64
+}
+
+type memExpression struct {
+	expr    Expression
+	actions []Action
+	vars    map[int64]Variable
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       map[int64]*User{},
+		usernames:   map[string]int64{},
+		exprs:       map[int64]map[int64]*memExpression{},
+		exprSeqs:    map[int64]int64{},
+		functions:   map[int64]map[string]Function{},
+		idempotency: map[int64]map[string]IdempotencyKey{},
+		quotas:      map[int64]Quota{},
+		schedules:   map[int64]Schedule{},
+		webhooks:    map[[2]int64]PendingWebhook{},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Migrate ничего не делает: у хранилища в памяти нет схемы
+func (s *MemoryStore) Migrate(ctx context.Context) ([]Migration, error) {
+	return nil, nil
+}
+
+func (s *MemoryStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return nil, nil
+}
+
+func (s *MemoryStore) InsertUser(ctx context.Context, user *User) (int64, error) {
+	cryptedPassword, err := CryptPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.usernames[user.Username]; ok {
+		return 0, errUsernameTaken
+	}
+	s.lastUserID++
+	s.users[s.lastUserID] = &User{ID: s.lastUserID, Username: user.Username, Password: cryptedPassword}
+	s.usernames[user.Username] = s.lastUserID
+	return s.lastUserID, nil
+}
+
+func (s *MemoryStore) SelectUser(ctx context.Context, username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[s.usernames[username]]
+	if !ok {
+		return User{}, nil
+	}
+	return User{ID: u.ID, Username: u.Username, Password: u.Password}, nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	delete(s.usernames, u.Username)
+	delete(s.users, userID)
+	delete(s.exprs, userID)
+	delete(s.exprSeqs, userID)
+	delete(s.functions, userID)
+	delete(s.idempotency, userID)
+	delete(s.quotas, userID)
+	maps.DeleteFunc(s.schedules, func(_ int64, sc Schedule) bool { return sc.UserID == userID })
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d WebhookDelivery) bool { return d.UserID == userID })
+	maps.DeleteFunc(s.webhooks, func(k [2]int64, _ PendingWebhook) bool { return k[0] == userID })
+	return nil
+}
+
+func (s *MemoryStore) InsertExpression(ctx context.Context, userID int64, expr *Expression) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertExpression(userID, expr)
+}
+
+func (s *MemoryStore) insertExpression(userID int64, expr *Expression) (int64, error) {
+	if _, ok := s.users[userID]; !ok {
+		return 0, errUnknownUser
+	}
+	if s.exprs[userID] == nil {
+		s.exprs[userID] = map[int64]*memExpression{}
+	}
+
+	s.exprSeqs[userID]++
+	id := s.exprSeqs[userID]
+
+	createdAt := time.Now()
+	if expr.CreatedAt != nil {
+		createdAt = *expr.CreatedAt
+	}
+	s.exprs[userID][id] = &memExpression{
+		expr: Expression{
+			ID:          id,
+			UserID:      userID,
+			Status:      expr.Status,
+			Result:      expr.Result,
+			Expression:  expr.Expression,
+			CallbackURL: expr.CallbackURL,
+			CreatedAt:   fromMillis(toMillis(createdAt)),
+			StartedAt:   fromMillis(ptrMillis(expr.StartedAt)),
+			CompletedAt: fromMillis(ptrMillis(expr.CompletedAt)),
+			ComputeMs:   expr.ComputeMs,
+			Priority:    expr.Priority,
+			RunAt:       fromMillis(ptrMillis(expr.RunAt)),
+			ScheduleID:  expr.ScheduleID,
+			RerunOf:     expr.RerunOf,
+		},
+		vars: map[int64]Variable{},
+	}
+	return id, nil
+}
+
+// InsertExpressions сохраняет выражения целиком или не сохраняет ничего
+func (s *MemoryStore) InsertExpressions(ctx context.Context, userID int64, exprs []Expression) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, errUnknownUser
+	}
+
+	ids := make([]int64, 0, len(exprs))
+	for _, expr := range exprs {
+		exprID, err := s.insertExpression(userID, &expr)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range expr.Actions {
+			s.insertAction(exprID, userID, &a)
+		}
+		for i, v := range expr.Variables {
+			s.insertVariable(exprID, userID, int64(i+1), &v)
+		}
+		ids = append(ids, exprID)
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) expression(userID, exprID int64) *memExpression {
+	return s.exprs[userID][exprID]
+}
+
+// sortedExpressions возвращает копии выражений пользователя по возрастанию id
+func (s *MemoryStore) sortedExpressions(userID int64) []Expression {
+	exprs := make([]Expression, 0, len(s.exprs[userID]))
+	for _, e := range s.exprs[userID] {
+		exprs = append(exprs, e.expr)
+	}
+	sort.Slice(exprs, func(i, j int) bool { return exprs[i].ID < exprs[j].ID })
+	return exprs
+}
+
+func (s *MemoryStore) SelectExpressions(ctx context.Context, userID int64) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exprs := s.sortedExpressions(userID)
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	return exprs, nil
+}
+
+func (s *MemoryStore) SelectExpression(ctx context.Context, userID, exprID int64) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.expression(userID, exprID)
+	if e == nil {
+		return nil, nil
+	}
+	return []Expression{e.expr}, nil
+}
+
+func (f ExpressionFilter) match(e Expression) bool {
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, e.Status) {
+		return false
+	}
+	if slices.Contains(f.ExceptStatuses, e.Status) {
+		return false
+	}
+	if f.ScheduleID != 0 && e.ScheduleID != f.ScheduleID {
+		return false
+	}
+	if f.RerunOf != 0 && e.RerunOf != f.RerunOf {
+		return false
+	}
+	created := ptrMillis(e.CreatedAt)
+	if !f.CreatedFrom.IsZero() && created < f.CreatedFrom.UnixMilli() {
+		return false
+	}
+	if !f.CreatedTo.IsZero() && created >= f.CreatedTo.UnixMilli() {
+		return false
+	}
+	return true
+}
+
+func (s *MemoryStore) SelectExpressionsPage(ctx context.Context, userID int64, f ExpressionFilter) ([]Expression, error) {
+	if _, ok := sortColumns[f.SortBy]; !ok {
+		return nil, fmt.Errorf("unknown sort %q", f.SortBy)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Сравнение пар (ключ, id) такое же, как в SQL запросе
+	less := func(a, b Expression) bool {
+		ka, kb := a.SortKey(f.SortBy), b.SortKey(f.SortBy)
+		if ka != kb {
+			return ka < kb
+		}
+		return a.ID < b.ID
+	}
+	after := func(e Expression) bool {
+		cursor := Expression{ID: f.AfterID}
+		if f.SortBy != "id" {
+			k := time.UnixMilli(f.AfterKey)
+			cursor.CreatedAt, cursor.CompletedAt = &k, &k
+		}
+		if f.Desc {
+			return less(e, cursor)
+		}
+		return less(cursor, e)
+	}
+
+	var exprs []Expression
+	for _, e := range s.sortedExpressions(userID) {
+		if f.match(e) && (f.AfterID == 0 || after(e)) {
+			exprs = append(exprs, e)
+		}
+	}
+	sort.SliceStable(exprs, func(i, j int) bool {
+		if f.Desc {
+			return less(exprs[j], exprs[i])
+		}
+		return less(exprs[i], exprs[j])
+	})
+
+	if len(exprs) > f.Limit {
+		exprs = exprs[:f.Limit]
+	}
+	if exprs == nil {
+		exprs = []Expression{}
+	}
+	return exprs, nil
+}
+
+func (s *MemoryStore) CountExpressions(ctx context.Context, userID int64, f ExpressionFilter) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, e := range s.exprs[userID] {
+		if f.match(e.expr) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) sortedUserIDs() []int64 {
+	userIDs := make([]int64, 0, len(s.exprs))
+	for userID := range s.exprs {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+	return userIDs
+}
+
+func (s *MemoryStore) SelectExpressionsByStatus(ctx context.Context, status string) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exprs []Expression
+	for _, userID := range s.sortedUserIDs() {
+		for _, e := range s.sortedExpressions(userID) {
+			if e.Status == status {
+				exprs = append(exprs, e)
+			}
+		}
+	}
+	return exprs, nil
+}
+
+func (s *MemoryStore) SelectNextRunAt(ctx context.Context) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *time.Time
+	for _, exprs := range s.exprs {
+		for _, e := range exprs {
+			if e.expr.Status == "scheduled" && e.expr.RunAt != nil && (next == nil || e.expr.RunAt.Before(*next)) {
+				next = e.expr.RunAt
+			}
+		}
+	}
+	return clonePtr(next), nil
+}
+
+func (s *MemoryStore) PromoteExpressions(ctx context.Context, now time.Time) ([]Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exprs []Expression
+	for _, userID := range s.sortedUserIDs() {
+		for _, e := range s.sortedExpressions(userID) {
+			if e.Status == "scheduled" && ptrMillis(e.RunAt) <= toMillis(now) {
+				s.expression(userID, e.ID).expr.Status = "under consideration"
+				e.Status = "under consideration"
+				exprs = append(exprs, e)
+			}
+		}
+	}
+	return exprs, nil
+}
+
+func (s *MemoryStore) UpdateExpression(ctx context.Context, userID, exprID int64, expr *Expression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.expression(userID, exprID); e != nil {
+		e.expr.Status = expr.Status
+		e.expr.Result = expr.Result
+		e.expr.CompletedAt = fromMillis(ptrMillis(expr.CompletedAt))
+		e.expr.ComputeMs = expr.ComputeMs
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateExpressionStarted(ctx context.Context, userID, exprID int64, startedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.expression(userID, exprID); e != nil && e.expr.StartedAt == nil {
+		e.expr.StartedAt = fromMillis(toMillis(startedAt))
+	}
+	return nil
+}
+
+func (s *MemoryStore) insertAction(exprID, userID int64, action *Action) (int64, error) {
+	e := s.expression(userID, exprID)
+	if e == nil {
+		return 0, errUnknownExpression
+	}
+
+	a := *action
+	a.ID = int64(len(e.actions) + 1)
+	a.ExpressionID = exprID
+	a.UserID = userID
+	a.IdDepends = slices.Clone(action.IdDepends)
+	a.Agent, a.StartedAt, a.FinishedAt = "", nil, nil
+	e.actions = append(e.actions, a)
+	return a.ID, nil
+}
+
+func (s *MemoryStore) SelectActions(ctx context.Context, userID, exprID int64) ([]Action, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.expression(userID, exprID)
+	if e == nil || len(e.actions) == 0 {
+		return nil, nil
+	}
+	actions := make([]Action, len(e.actions))
+	for i, a := range e.actions {
+		a.IdDepends = slices.Clone(a.IdDepends)
+		actions[i] = a
+	}
+	return actions, nil
+}
+
+// action возвращает действие для изменения или nil, если его нет
+func (s *MemoryStore) action(userID, exprID, actionID int64) *Action {
+	e := s.expression(userID, exprID)
+	if e == nil || actionID < 1 || actionID > int64(len(e.actions)) {
+		return nil
+	}
+	return &e.actions[actionID-1]
+}
+
+func (s *MemoryStore) UpdateActionStatus(ctx context.Context, userID, exprID, actionID int64, completed, nowCalculate bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a := s.action(userID, exprID, actionID); a != nil {
+		a.Completed, a.NowCalculate = completed, nowCalculate
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateActionResult(ctx context.Context, userID, exprID, actionID int64, result float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a := s.action(userID, exprID, actionID); a != nil {
+		a.Result = result
+	}
+	return nil
+}
+
+func (s *MemoryStore) ClaimAction(ctx context.Context, userID, exprID, actionID int64, agent string, startedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.action(userID, exprID, actionID)
+	if a == nil || a.NowCalculate || a.Completed {
+		return false, nil
+	}
+	a.NowCalculate = true
+	a.Agent = agent
+	a.StartedAt = fromMillis(toMillis(startedAt))
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseActions(ctx context.Context, userID, exprID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.expression(userID, exprID)
+	if e == nil {
+		return 0, nil
+	}
+	var n int64
+	for i := range e.actions {
+		a := &e.actions[i]
+		if a.NowCalculate && !a.Completed {
+			a.NowCalculate, a.Agent, a.StartedAt = false, "", nil
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) UpdateActions(ctx context.Context, actions []Action) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, update := range actions {
+		if a := s.action(update.UserID, update.ExpressionID, update.ID); a != nil {
+			a.Result, a.Completed, a.NowCalculate, a.Agent = update.Result, update.Completed, update.NowCalculate, update.Agent
+			a.StartedAt = fromMillis(ptrMillis(update.StartedAt))
+			a.FinishedAt = fromMillis(ptrMillis(update.FinishedAt))
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateActionFinished(ctx context.Context, userID, exprID, actionID int64, finishedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a := s.action(userID, exprID, actionID); a != nil {
+		a.FinishedAt = fromMillis(toMillis(finishedAt))
+	}
+	return nil
+}
+
+func (s *MemoryStore) InsertVariable(ctx context.Context, exprID, userID, id int64, v *Variable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertVariable(exprID, userID, id, v)
+}
+
+func (s *MemoryStore) insertVariable(exprID, userID, id int64, v *Variable) error {
+	e := s.expression(userID, exprID)
+	if e == nil {
+		return errUnknownExpression
+	}
+	e.vars[id] = Variable{Name: v.Name, ActionID: v.ActionID, Value: v.Value}
+	return nil
+}
+
+// SelectVariables берёт значение переменной из вычисляющего её действия, как LEFT JOIN в SQL
+func (s *MemoryStore) SelectVariables(ctx context.Context, userID, exprID int64) ([]Variable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.expression(userID, exprID)
+	if e == nil {
+		return nil, nil
+	}
+	ids := make([]int64, 0, len(e.vars))
+	for id := range e.vars {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var vars []Variable
+	for _, id := range ids {
+		v := e.vars[id]
+		v.Completed = true
+		if v.ActionID >= 1 && v.ActionID <= int64(len(e.actions)) {
+			a := e.actions[v.ActionID-1]
+			v.Value, v.Completed = a.Result, a.Completed
+		}
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+func (s *MemoryStore) InsertFunction(ctx context.Context, userID int64, f *Function) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return errUnknownUser
+	}
+	if s.functions[userID] == nil {
+		s.functions[userID] = map[string]Function{}
+	}
+
+	stored, ok := s.functions[userID][f.Name]
+	if !ok {
+		s.lastFuncID++
+		stored = Function{ID: s.lastFuncID, UserID: userID, Name: f.Name}
+	}
+	stored.Params = slices.Clone(f.Params)
+	stored.Body = f.Body
+	s.functions[userID][f.Name] = stored
+	return nil
+}
+
+func (s *MemoryStore) SelectFunctions(ctx context.Context, userID int64) ([]Function, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var funcs []Function
+	for _, f := range s.functions[userID] {
+		f.Params = slices.Clone(f.Params)
+		funcs = append(funcs, f)
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].Name < funcs[j].Name })
+	return funcs, nil
+}
+
+func (s *MemoryStore) DeleteFunction(ctx context.Context, userID int64, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.functions[userID][name]; !ok {
+		return false, nil
+	}
+	delete(s.functions[userID], name)
+	return true, nil
+}
+
+func (s *MemoryStore) InsertWebhookDelivery(ctx context.Context, d *WebhookDelivery) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expression(d.UserID, d.ExpressionID) == nil {
+		return 0, errUnknownExpression
+	}
+	s.lastDelivery++
+	stored := *d
+	stored.ID = s.lastDelivery
+	stored.CreatedAt = time.UnixMilli(toMillis(d.CreatedAt))
+	s.deliveries = append(s.deliveries, stored)
+	return stored.ID, nil
+}
+
+func (s *MemoryStore) SelectWebhookDeliveries(ctx context.Context, userID, exprID int64) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.UserID == userID && d.ExpressionID == exprID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) InsertPendingWebhook(ctx context.Context, p *PendingWebhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expression(p.UserID, p.ExpressionID) == nil {
+		return errUnknownExpression
+	}
+	key := [2]int64{p.UserID, p.ExpressionID}
+	if _, ok := s.webhooks[key]; ok {
+		return nil
+	}
+	stored := *p
+	stored.NextAttemptAt = time.UnixMilli(toMillis(p.NextAttemptAt))
+	stored.CreatedAt = time.UnixMilli(toMillis(p.CreatedAt))
+	s.webhooks[key] = stored
+	return nil
+}
+
+func (s *MemoryStore) SelectDueWebhooks(ctx context.Context, now time.Time) ([]PendingWebhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending []PendingWebhook
+	for _, p := range s.webhooks {
+		if toMillis(p.NextAttemptAt) <= toMillis(now) {
+			pending = append(pending, p)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].NextAttemptAt.Before(pending[j].NextAttemptAt) })
+	return pending, nil
+}
+
+func (s *MemoryStore) SelectNextWebhookAttempt(ctx context.Context) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *time.Time
+	for _, p := range s.webhooks {
+		if next == nil || p.NextAttemptAt.Before(*next) {
+			next = &p.NextAttemptAt
+		}
+	}
+	return clonePtr(next), nil
+}
+
+func (s *MemoryStore) ClaimPendingWebhook(ctx context.Context, userID, exprID int64, at, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]int64{userID, exprID}
+	p, ok := s.webhooks[key]
+	if !ok || toMillis(p.NextAttemptAt) != toMillis(at) {
+		return false, nil
+	}
+	p.NextAttemptAt = time.UnixMilli(toMillis(until))
+	s.webhooks[key] = p
+	return true, nil
+}
+
+func (s *MemoryStore) UpdatePendingWebhook(ctx context.Context, p *PendingWebhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]int64{p.UserID, p.ExpressionID}
+	if stored, ok := s.webhooks[key]; ok {
+		stored.Attempt = p.Attempt
+		stored.NextAttemptAt = time.UnixMilli(toMillis(p.NextAttemptAt))
+		s.webhooks[key] = stored
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeletePendingWebhook(ctx context.Context, userID, exprID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.webhooks, [2]int64{userID, exprID})
+	return nil
+}
+
+func (s *MemoryStore) InsertIdempotencyKey(ctx context.Context, k *IdempotencyKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[k.UserID]; !ok {
+		return false, errUnknownUser
+	}
+	if s.idempotency[k.UserID] == nil {
+		s.idempotency[k.UserID] = map[string]IdempotencyKey{}
+	}
+	if _, ok := s.idempotency[k.UserID][k.Key]; ok {
+		return false, nil
+	}
+	s.idempotency[k.UserID][k.Key] = IdempotencyKey{
+		UserID:      k.UserID,
+		Key:         k.Key,
+		RequestHash: k.RequestHash,
+		CreatedAt:   time.UnixMilli(toMillis(k.CreatedAt)),
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) SelectIdempotencyKey(ctx context.Context, userID int64, key string) (IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.idempotency[userID][key]
+	if !ok {
+		return IdempotencyKey{}, sql.ErrNoRows
+	}
+	return k, nil
+}
+
+func (s *MemoryStore) UpdateIdempotencyKey(ctx context.Context, userID int64, key string, exprID int64, statusCode int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.idempotency[userID][key]; ok {
+		k.ExpressionID, k.StatusCode = exprID, statusCode
+		s.idempotency[userID][key] = k
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReclaimIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[k.UserID][k.Key]
+	if !ok || stored.ExpressionID != 0 || toMillis(stored.CreatedAt) >= toMillis(staleBefore) {
+		return false, nil
+	}
+	stored.RequestHash = k.RequestHash
+	stored.CreatedAt = time.UnixMilli(toMillis(k.CreatedAt))
+	s.idempotency[k.UserID][k.Key] = stored
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency[userID], key)
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredIdempotencyKeys(ctx context.Context, userID int64, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, k := range s.idempotency[userID] {
+		if toMillis(k.CreatedAt) < toMillis(before) {
+			delete(s.idempotency[userID], key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) InsertQuota(ctx context.Context, q *Quota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[q.UserID]; !ok {
+		return errUnknownUser
+	}
+	s.quotas[q.UserID] = Quota{
+		UserID:     q.UserID,
+		RPS:        clonePtr(q.RPS),
+		Burst:      clonePtr(q.Burst),
+		MaxPending: clonePtr(q.MaxPending),
+		MaxActions: clonePtr(q.MaxActions),
+	}
+	return nil
+}
+
+func (s *MemoryStore) SelectQuota(ctx context.Context, userID int64) (Quota, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.quotas[userID]
+	if !ok {
+		return Quota{UserID: userID}, nil
+	}
+	return Quota{
+		UserID:     userID,
+		RPS:        clonePtr(q.RPS),
+		Burst:      clonePtr(q.Burst),
+		MaxPending: clonePtr(q.MaxPending),
+		MaxActions: clonePtr(q.MaxActions),
+	}, nil
+}
+
+func (s *MemoryStore) DeleteQuota(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.quotas, userID)
+	return nil
+}
+
+func (s *MemoryStore) InsertSchedule(ctx context.Context, sc *Schedule) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[sc.UserID]; !ok {
+		return 0, errUnknownUser
+	}
+	s.lastSchedule++
+	stored := *sc
+	stored.ID = s.lastSchedule
+	stored.NextRunAt = fromMillis(ptrMillis(sc.NextRunAt))
+	stored.LastRunAt = fromMillis(ptrMillis(sc.LastRunAt))
+	stored.CreatedAt = time.UnixMilli(toMillis(sc.CreatedAt))
+	s.schedules[stored.ID] = stored
+	return stored.ID, nil
+}
+
+// sortedSchedules возвращает копии подходящих расписаний по возрастанию id
+func (s *MemoryStore) sortedSchedules(match func(Schedule) bool) []Schedule {
+	var schedules []Schedule
+	for _, sc := range s.schedules {
+		if match(sc) {
+			sc.NextRunAt, sc.LastRunAt = clonePtr(sc.NextRunAt), clonePtr(sc.LastRunAt)
+			schedules = append(schedules, sc)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules
+}
+
+func (s *MemoryStore) SelectSchedules(ctx context.Context, userID int64) ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedSchedules(func(sc Schedule) bool { return sc.UserID == userID }), nil
+}
+
+func (s *MemoryStore) SelectSchedule(ctx context.Context, userID, id int64) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := s.sortedSchedules(func(sc Schedule) bool { return sc.UserID == userID && sc.ID == id })
+	if len(found) == 0 {
+		return Schedule{}, sql.ErrNoRows
+	}
+	return found[0], nil
+}
+
+func (s *MemoryStore) SelectDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedSchedules(func(sc Schedule) bool {
+		return !sc.Paused && sc.NextRunAt != nil && ptrMillis(sc.NextRunAt) <= toMillis(now)
+	}), nil
+}
+
+func (s *MemoryStore) SelectNextScheduleRun(ctx context.Context) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *time.Time
+	for _, sc := range s.schedules {
+		if !sc.Paused && sc.NextRunAt != nil && (next == nil || sc.NextRunAt.Before(*next)) {
+			next = sc.NextRunAt
+		}
+	}
+	return clonePtr(next), nil
+}
+
+func (s *MemoryStore) UpdateSchedule(ctx context.Context, sc *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.schedules[sc.ID]; ok && stored.UserID == sc.UserID {
+		stored.Paused = sc.Paused
+		stored.NextRunAt = fromMillis(ptrMillis(sc.NextRunAt))
+		s.schedules[sc.ID] = stored
+	}
+	return nil
+}
+
+func (s *MemoryStore) ClaimScheduleRun(ctx context.Context, userID, id int64, runAt, next time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok || sc.UserID != userID || sc.Paused || ptrMillis(sc.NextRunAt) != toMillis(runAt) {
+		return false, nil
+	}
+	sc.LastRunAt = fromMillis(toMillis(runAt))
+	sc.NextRunAt = fromMillis(toMillis(next))
+	s.schedules[id] = sc
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteSchedule(ctx context.Context, userID, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sc, ok := s.schedules[id]; !ok || sc.UserID != userID {
+		return false, nil
+	}
+	delete(s.schedules, id)
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteScheduleRuns(ctx context.Context, userID, scheduleID int64, keep int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var runs []Expression
+	for _, e := range s.sortedExpressions(userID) {
+		if e.ScheduleID == scheduleID {
+			runs = append(runs, e)
+		}
+	}
+
+	deleted := map[int64]bool{}
+	for i := 0; i < len(runs)-keep; i++ {
+		if status := runs[i].Status; status != "under consideration" && status != "scheduled" {
+			delete(s.exprs[userID], runs[i].ID)
+			deleted[runs[i].ID] = true
+		}
+	}
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d WebhookDelivery) bool {
+		return d.UserID == userID && deleted[d.ExpressionID]
+	})
+	maps.DeleteFunc(s.webhooks, func(k [2]int64, _ PendingWebhook) bool { return k[0] == userID && deleted[k[1]] })
+	return int64(len(deleted)), nil
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// Migration - один файл migrations/<диалект>/NNNN_name.sql. Миграции применяются по возрастанию Version
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus - миграция и время её применения; AppliedAt равен nil, если она ещё не применена
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+const migrationsTable = `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at BIGINT NOT NULL
+    );`
+
+// Migrations возвращает встроенные в бинарник миграции диалекта, упорядоченные по версии
+func Migrations(d Dialect) ([]Migration, error) {
+	dir := "migrations/" + string(d)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, e := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		n, err := strconv.Atoi(version)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("incorrect migration file name %q", e.Name())
+		}
+		body, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: n, Name: name, SQL: string(body)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate применяет все ещё не применённые миграции, каждую в своей транзакции,
+// и возвращает применённые. База со схемой новее бинарника не трогается.
+func Migrate(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	d := DialectOf(db)
+	migrations, err := Migrations(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == SQLite {
+		if err := upgradeLegacy(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := db.ExecContext(ctx, migrationsTable); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return nil, fmt.Errorf("database schema version %d is newer than this build", version)
+		}
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	q := "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, q, m.Version, m.Name, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SelectMigrationStatus сопоставляет встроенные миграции с записями schema_migrations
+func SelectMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return nil, err
+	}
+	// Статус только читается: таблица, созданная здесь, спрятала бы базу старой версии от upgradeLegacy
+	applied := map[int]int64{}
+	migrated, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		if applied, err = appliedMigrations(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Migration: m}
+		if ms, ok := applied[m.Version]; ok {
+			t := time.UnixMilli(ms)
+			st.AppliedAt = &t
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// upgradeLegacy досоздаёт колонки в базах, созданных CreateTables до появления миграций,
+// чтобы первая миграция, создающая таблицы через IF NOT EXISTS, нашла их в актуальном виде.
+func upgradeLegacy(ctx context.Context, db *sql.DB) error {
+	migrated, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil || migrated {
+		return err
+	}
+
+	err = addColumns(ctx, db, "expressions", [][2]string{
+		{"callback_url", "TEXT NOT NULL DEFAULT ''"},
+		{"created_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"completed_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"expression", "TEXT NOT NULL DEFAULT ''"},
+		{"started_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"compute_ms", "INTEGER NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	return addColumns(ctx, db, "actions", [][2]string{
+		{"agent", "TEXT NOT NULL DEFAULT ''"},
+		{"started_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"finished_at", "INTEGER NOT NULL DEFAULT 0"},
+	})
+}
+
+// addColumns досоздаёт колонки, которых нет в таблицах, созданных старыми версиями CreateTables.
+func addColumns(ctx context.Context, db *sql.DB, table string, columns [][2]string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// Таблицы нет - её создаст миграция
+	if len(existing) == 0 {
+		return nil
+	}
+
+	for _, c := range columns {
+		if existing[c[0]] {
+			continue
+		}
+		q := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c[0], c[1])
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func tableExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var n int
+	q := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1"
+	if DialectOf(db) == Postgres {
+		q = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+	}
+	err := db.QueryRowContext(ctx, q, name).Scan(&n)
+	return n > 0, err
+}
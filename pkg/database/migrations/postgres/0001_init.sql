@@ -0,0 +1,89 @@
+-- Та же схема, что и migrations/sqlite/0001_init.sql, в типах PostgreSQL.
+-- Время хранится в миллисекундах unix (BIGINT), 0 - не задано.
+
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+    id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    status TEXT,
+    result DOUBLE PRECISION,
+    expression TEXT NOT NULL DEFAULT '',
+    callback_url TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL DEFAULT 0,
+    started_at BIGINT NOT NULL DEFAULT 0,
+    completed_at BIGINT NOT NULL DEFAULT 0,
+    compute_ms BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (user_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS actions (
+    id BIGINT,
+    expression_id BIGINT NOT NULL,
+    user_id BIGINT,
+    arg1 DOUBLE PRECISION,
+    arg2 DOUBLE PRECISION,
+    result DOUBLE PRECISION,
+    operation TEXT,
+    id_depends TEXT,
+    completed BOOLEAN,
+    now_calculate BOOLEAN,
+    agent TEXT NOT NULL DEFAULT '',
+    started_at BIGINT NOT NULL DEFAULT 0,
+    finished_at BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id, expression_id) REFERENCES expressions(user_id, id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS actions_expression ON actions (user_id, expression_id, id);
+
+CREATE TABLE IF NOT EXISTS variables (
+    id BIGINT NOT NULL,
+    expression_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    action_id BIGINT NOT NULL,
+    value DOUBLE PRECISION,
+    FOREIGN KEY (user_id, expression_id) REFERENCES expressions(user_id, id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS functions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    params TEXT NOT NULL,
+    body TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    expression_id BIGINT NOT NULL,
+    url TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    FOREIGN KEY (user_id, expression_id) REFERENCES expressions(user_id, id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id BIGINT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    expression_id BIGINT NOT NULL DEFAULT 0,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (user_id, key),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS expressions_user_status ON expressions (user_id, status, id);
+CREATE INDEX IF NOT EXISTS expressions_user_created ON expressions (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS expressions_user_completed ON expressions (user_id, completed_at, id);
@@ -0,0 +1,11 @@
+-- Последний выданный номер выражения каждого пользователя. Номер берётся из этой таблицы
+-- в той же транзакции, что и вставка выражения, вместо MAX(id) + 1
+
+CREATE TABLE IF NOT EXISTS expression_sequences (
+    user_id BIGINT PRIMARY KEY,
+    last_id BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO expression_sequences (user_id, last_id)
+SELECT user_id, MAX(id) FROM expressions GROUP BY user_id;
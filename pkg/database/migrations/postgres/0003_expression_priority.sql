@@ -0,0 +1,4 @@
+-- Приоритет выражения: из готовых действий пользователя первыми раздаются действия
+-- выражений с большим приоритетом
+
+ALTER TABLE expressions ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
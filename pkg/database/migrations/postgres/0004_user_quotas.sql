@@ -0,0 +1,10 @@
+-- Личные лимиты пользователя. NULL - действует общий лимит из настроек orchestrator
+
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id BIGINT PRIMARY KEY,
+    rps DOUBLE PRECISION,
+    burst INTEGER,
+    max_pending INTEGER,
+    max_actions INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
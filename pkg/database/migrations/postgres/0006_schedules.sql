@@ -0,0 +1,23 @@
+-- Повторяющиеся выражения по расписанию cron. Каждый запуск создаёт выражение
+-- со ссылкой schedule_id; keep - сколько последних запусков хранить.
+-- next_run_at и last_run_at - unix-миллисекунды, 0 - нет (расписание на паузе или ещё не запускалось)
+
+CREATE TABLE IF NOT EXISTS schedules (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    expression TEXT NOT NULL,
+    cron TEXT NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    keep INTEGER NOT NULL,
+    paused BOOLEAN NOT NULL DEFAULT FALSE,
+    next_run_at BIGINT NOT NULL DEFAULT 0,
+    last_run_at BIGINT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS schedules_next_run ON schedules (paused, next_run_at);
+
+ALTER TABLE expressions ADD COLUMN IF NOT EXISTS schedule_id BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS expressions_user_schedule ON expressions (user_id, schedule_id, id);
@@ -0,0 +1,5 @@
+-- Повторный запуск выражения: rerun_of - номер исходного выражения того же пользователя, 0 - не повтор
+
+ALTER TABLE expressions ADD COLUMN IF NOT EXISTS rerun_of BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS expressions_user_rerun_of ON expressions (user_id, rerun_of, id);
@@ -0,0 +1,16 @@
+-- Очередь доставки результатов на callback_url. Строка живёт, пока результат не доставлен
+-- и попытки не кончились, поэтому доставка продолжается после перезапуска orchestrator.
+-- attempt - сколько попыток уже сделано, next_attempt_at и created_at - unix-миллисекунды
+
+CREATE TABLE IF NOT EXISTS webhook_queue (
+    user_id BIGINT NOT NULL,
+    expression_id BIGINT NOT NULL,
+    url TEXT NOT NULL,
+    attempt INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (user_id, expression_id),
+    FOREIGN KEY (user_id, expression_id) REFERENCES expressions(user_id, id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_queue_next_attempt ON webhook_queue (next_attempt_at);
@@ -0,0 +1,87 @@
+-- Схема, которую создавал CreateTables до появления миграций
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT UNIQUE NOT NULL,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+    id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    status TEXT,
+    result REAL,
+    expression TEXT NOT NULL DEFAULT '',
+    callback_url TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL DEFAULT 0,
+    started_at INTEGER NOT NULL DEFAULT 0,
+    completed_at INTEGER NOT NULL DEFAULT 0,
+    compute_ms INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (user_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS actions (
+    id INTEGER,
+    expression_id INTEGER NOT NULL,
+    user_id INTEGER,
+    arg1 REAL,
+    arg2 REAL,
+    result REAL,
+    operation TEXT,
+    id_depends TEXT,
+    completed BOOLEAN,
+    now_calculate BOOLEAN,
+    agent TEXT NOT NULL DEFAULT '',
+    started_at INTEGER NOT NULL DEFAULT 0,
+    finished_at INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (expression_id, user_id) REFERENCES expressions(id, user_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS variables (
+    id INTEGER NOT NULL,
+    expression_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    action_id INTEGER NOT NULL,
+    value REAL,
+    FOREIGN KEY (expression_id, user_id) REFERENCES expressions(id, user_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS functions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    params TEXT NOT NULL,
+    body TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    expression_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (expression_id, user_id) REFERENCES expressions(id, user_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    expression_id INTEGER NOT NULL DEFAULT 0,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, key),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- Индексы для постраничного списка выражений: фильтр по пользователю и статусу, сортировка по времени
+CREATE INDEX IF NOT EXISTS expressions_user_status ON expressions (user_id, status, id);
+CREATE INDEX IF NOT EXISTS expressions_user_created ON expressions (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS expressions_user_completed ON expressions (user_id, completed_at, id);
@@ -0,0 +1,6 @@
+-- Отложенные выражения: до наступления run_at (unix-миллисекунды) выражение имеет статус
+-- scheduled, и его действия не раздаются. 0 - выражение не откладывалось
+
+ALTER TABLE expressions ADD COLUMN run_at INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS expressions_status_run_at ON expressions (status, run_at);
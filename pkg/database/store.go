@@ -0,0 +1,396 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dialect - вид SQL базы. От него зависят только миграции и служебные запросы к схеме,
+// остальные запросы (с плейсхолдерами $N и RETURNING) общие.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// DialectOf определяет диалект по драйверу, через который открыта база
+func DialectOf(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*pq.Driver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+// Store - хранилище пользователей, выражений и всего, что к ним относится.
+// Методы повторяют одноимённые функции пакета без параметра db. Потребители, которым
+// нужна только часть хранилища, принимают интерфейсы поменьше: ExpressionStore,
+// FunctionStore, ScheduleStore и остальные.
+type Store interface {
+	UserStore
+	ExpressionStore
+	FunctionStore
+	WebhookStore
+	IdempotencyStore
+	QuotaStore
+	ScheduleStore
+
+	Migrate(ctx context.Context) ([]Migration, error)
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	Close() error
+}
+
+type UserStore interface {
+	InsertUser(ctx context.Context, user *User) (int64, error)
+	SelectUser(ctx context.Context, username string) (User, error)
+	DeleteUser(ctx context.Context, userID int64) error
+}
+
+// ExpressionStore - выражения вместе с их действиями и переменными
+type ExpressionStore interface {
+	InsertExpression(ctx context.Context, userID int64, expr *Expression) (int64, error)
+	InsertExpressions(ctx context.Context, userID int64, exprs []Expression) ([]int64, error)
+	SelectExpressions(ctx context.Context, userID int64) ([]Expression, error)
+	SelectExpression(ctx context.Context, userID, exprID int64) ([]Expression, error)
+	SelectExpressionsPage(ctx context.Context, userID int64, f ExpressionFilter) ([]Expression, error)
+	CountExpressions(ctx context.Context, userID int64, f ExpressionFilter) (int64, error)
+	SelectNextRunAt(ctx context.Context) (*time.Time, error)
+	SelectExpressionsByStatus(ctx context.Context, status string) ([]Expression, error)
+	UpdateExpression(ctx context.Context, userID, exprID int64, expr *Expression) error
+	UpdateExpressionStarted(ctx context.Context, userID, exprID int64, startedAt time.Time) error
+	PromoteExpressions(ctx context.Context, now time.Time) ([]Expression, error)
+
+	SelectActions(ctx context.Context, userID, exprID int64) ([]Action, error)
+	UpdateActionStatus(ctx context.Context, userID, exprID, actionID int64, completed, nowCalculate bool) error
+	UpdateActionResult(ctx context.Context, userID, exprID, actionID int64, result float64) error
+	ClaimAction(ctx context.Context, userID, exprID, actionID int64, agent string, startedAt time.Time) (bool, error)
+	ReleaseActions(ctx context.Context, userID, exprID int64) (int64, error)
+	UpdateActions(ctx context.Context, actions []Action) error
+	UpdateActionFinished(ctx context.Context, userID, exprID, actionID int64, finishedAt time.Time) error
+
+	InsertVariable(ctx context.Context, exprID, userID, id int64, v *Variable) error
+	SelectVariables(ctx context.Context, userID, exprID int64) ([]Variable, error)
+}
+
+type FunctionStore interface {
+	InsertFunction(ctx context.Context, userID int64, f *Function) error
+	SelectFunctions(ctx context.Context, userID int64) ([]Function, error)
+	DeleteFunction(ctx context.Context, userID int64, name string) (bool, error)
+}
+
+// WebhookStore - очередь доставки результатов на callback_url и журнал попыток
+type WebhookStore interface {
+	InsertWebhookDelivery(ctx context.Context, d *WebhookDelivery) (int64, error)
+	SelectWebhookDeliveries(ctx context.Context, userID, exprID int64) ([]WebhookDelivery, error)
+	InsertPendingWebhook(ctx context.Context, p *PendingWebhook) error
+	SelectDueWebhooks(ctx context.Context, now time.Time) ([]PendingWebhook, error)
+	SelectNextWebhookAttempt(ctx context.Context) (*time.Time, error)
+	ClaimPendingWebhook(ctx context.Context, userID, exprID int64, at, until time.Time) (bool, error)
+	UpdatePendingWebhook(ctx context.Context, p *PendingWebhook) error
+	DeletePendingWebhook(ctx context.Context, userID, exprID int64) error
+}
+
+type IdempotencyStore interface {
+	InsertIdempotencyKey(ctx context.Context, k *IdempotencyKey) (bool, error)
+	SelectIdempotencyKey(ctx context.Context, userID int64, key string) (IdempotencyKey, error)
+	UpdateIdempotencyKey(ctx context.Context, userID int64, key string, exprID int64, statusCode int) error
+	ReclaimIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (bool, error)
+	DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, userID int64, before time.Time) error
+}
+
+type QuotaStore interface {
+	InsertQuota(ctx context.Context, q *Quota) error
+	SelectQuota(ctx context.Context, userID int64) (Quota, error)
+	DeleteQuota(ctx context.Context, userID int64) error
+}
+
+type ScheduleStore interface {
+	InsertSchedule(ctx context.Context, sc *Schedule) (int64, error)
+	SelectSchedules(ctx context.Context, userID int64) ([]Schedule, error)
+	SelectSchedule(ctx context.Context, userID, id int64) (Schedule, error)
+	SelectDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error)
+	SelectNextScheduleRun(ctx context.Context) (*time.Time, error)
+	UpdateSchedule(ctx context.Context, sc *Schedule) error
+	ClaimScheduleRun(ctx context.Context, userID, id int64, runAt, next time.Time) (bool, error)
+	DeleteSchedule(ctx context.Context, userID, id int64) (bool, error)
+	DeleteScheduleRuns(ctx context.Context, userID, scheduleID int64, keep int) (int64, error)
+}
+
+// Open открывает хранилище по DSN: postgres:// и postgresql:// - PostgreSQL,
+// всё остальное (путь к файлу, возможно с префиксом sqlite://) - SQLite.
+func Open(dsn string) (*SQLStore, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return OpenPostgres(dsn)
+	}
+	return OpenSQLite(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
+// OpenSQLite открывает файл SQLite с включёнными внешними ключами на каждом соединении пула
+func OpenSQLite(path string) (*SQLStore, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite3", path+sep+"_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db)
+}
+
+func OpenPostgres(dsn string) (*SQLStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db)
+}
+
+func newSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := db.PingContext(context.TODO()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewSQLStore(db), nil
+}
+
+// SQLStore - Store поверх SQLite или PostgreSQL
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// DB возвращает соединение для функций пакета, которых нет в Store
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) Migrate(ctx context.Context) ([]Migration, error) {
+	return Migrate(ctx, s.db)
+}
+
+func (s *SQLStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return SelectMigrationStatus(ctx, s.db)
+}
+
+func (s *SQLStore) InsertUser(ctx context.Context, user *User) (int64, error) {
+	return InsertUser(ctx, s.db, user)
+}
+
+func (s *SQLStore) SelectUser(ctx context.Context, username string) (User, error) {
+	return SelectUser(ctx, s.db, username)
+}
+
+func (s *SQLStore) DeleteUser(ctx context.Context, userID int64) error {
+	return DeleteUser(ctx, s.db, userID)
+}
+
+func (s *SQLStore) InsertExpression(ctx context.Context, userID int64, expr *Expression) (int64, error) {
+	return InsertExpression(ctx, s.db, userID, expr)
+}
+
+func (s *SQLStore) InsertExpressions(ctx context.Context, userID int64, exprs []Expression) ([]int64, error) {
+	return InsertExpressions(ctx, s.db, userID, exprs)
+}
+
+func (s *SQLStore) SelectExpressions(ctx context.Context, userID int64) ([]Expression, error) {
+	return SelectExpressions(ctx, s.db, userID)
+}
+
+func (s *SQLStore) SelectExpression(ctx context.Context, userID, exprID int64) ([]Expression, error) {
+	return SelectExpression(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) SelectExpressionsPage(ctx context.Context, userID int64, f ExpressionFilter) ([]Expression, error) {
+	return SelectExpressionsPage(ctx, s.db, userID, f)
+}
+
+func (s *SQLStore) SelectNextRunAt(ctx context.Context) (*time.Time, error) {
+	return SelectNextRunAt(ctx, s.db)
+}
+
+func (s *SQLStore) CountExpressions(ctx context.Context, userID int64, f ExpressionFilter) (int64, error) {
+	return CountExpressions(ctx, s.db, userID, f)
+}
+
+func (s *SQLStore) SelectExpressionsByStatus(ctx context.Context, status string) ([]Expression, error) {
+	return SelectExpressionsByStatus(ctx, s.db, status)
+}
+
+func (s *SQLStore) UpdateExpression(ctx context.Context, userID, exprID int64, expr *Expression) error {
+	return UpdateExpression(ctx, s.db, userID, exprID, expr)
+}
+
+func (s *SQLStore) PromoteExpressions(ctx context.Context, now time.Time) ([]Expression, error) {
+	return PromoteExpressions(ctx, s.db, now)
+}
+
+func (s *SQLStore) UpdateExpressionStarted(ctx context.Context, userID, exprID int64, startedAt time.Time) error {
+	return UpdateExpressionStarted(ctx, s.db, userID, exprID, startedAt)
+}
+
+func (s *SQLStore) SelectActions(ctx context.Context, userID, exprID int64) ([]Action, error) {
+	return SelectActions(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) UpdateActionStatus(ctx context.Context, userID, exprID, actionID int64, completed, nowCalculate bool) error {
+	return UpdateActionStatus(ctx, s.db, userID, exprID, actionID, completed, nowCalculate)
+}
+
+func (s *SQLStore) UpdateActionResult(ctx context.Context, userID, exprID, actionID int64, result float64) error {
+	return UpdateActionResult(ctx, s.db, userID, exprID, actionID, result)
+}
+
+func (s *SQLStore) ClaimAction(ctx context.Context, userID, exprID, actionID int64, agent string, startedAt time.Time) (bool, error) {
+	return ClaimAction(ctx, s.db, userID, exprID, actionID, agent, startedAt)
+}
+
+func (s *SQLStore) ReleaseActions(ctx context.Context, userID, exprID int64) (int64, error) {
+	return ReleaseActions(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) UpdateActions(ctx context.Context, actions []Action) error {
+	return UpdateActions(ctx, s.db, actions)
+}
+
+func (s *SQLStore) UpdateActionFinished(ctx context.Context, userID, exprID, actionID int64, finishedAt time.Time) error {
+	return UpdateActionFinished(ctx, s.db, userID, exprID, actionID, finishedAt)
+}
+
+func (s *SQLStore) InsertVariable(ctx context.Context, exprID, userID, id int64, v *Variable) error {
+	return InsertVariable(ctx, s.db, exprID, userID, id, v)
+}
+
+func (s *SQLStore) SelectVariables(ctx context.Context, userID, exprID int64) ([]Variable, error) {
+	return SelectVariables(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) InsertFunction(ctx context.Context, userID int64, f *Function) error {
+	return InsertFunction(ctx, s.db, userID, f)
+}
+
+func (s *SQLStore) SelectFunctions(ctx context.Context, userID int64) ([]Function, error) {
+	return SelectFunctions(ctx, s.db, userID)
+}
+
+func (s *SQLStore) DeleteFunction(ctx context.Context, userID int64, name string) (bool, error) {
+	return DeleteFunction(ctx, s.db, userID, name)
+}
+
+func (s *SQLStore) InsertWebhookDelivery(ctx context.Context, d *WebhookDelivery) (int64, error) {
+	return InsertWebhookDelivery(ctx, s.db, d)
+}
+
+func (s *SQLStore) SelectWebhookDeliveries(ctx context.Context, userID, exprID int64) ([]WebhookDelivery, error) {
+	return SelectWebhookDeliveries(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) InsertPendingWebhook(ctx context.Context, p *PendingWebhook) error {
+	return InsertPendingWebhook(ctx, s.db, p)
+}
+
+func (s *SQLStore) SelectDueWebhooks(ctx context.Context, now time.Time) ([]PendingWebhook, error) {
+	return SelectDueWebhooks(ctx, s.db, now)
+}
+
+func (s *SQLStore) SelectNextWebhookAttempt(ctx context.Context) (*time.Time, error) {
+	return SelectNextWebhookAttempt(ctx, s.db)
+}
+
+func (s *SQLStore) ClaimPendingWebhook(ctx context.Context, userID, exprID int64, at, until time.Time) (bool, error) {
+	return ClaimPendingWebhook(ctx, s.db, userID, exprID, at, until)
+}
+
+func (s *SQLStore) UpdatePendingWebhook(ctx context.Context, p *PendingWebhook) error {
+	return UpdatePendingWebhook(ctx, s.db, p)
+}
+
+func (s *SQLStore) DeletePendingWebhook(ctx context.Context, userID, exprID int64) error {
+	return DeletePendingWebhook(ctx, s.db, userID, exprID)
+}
+
+func (s *SQLStore) InsertIdempotencyKey(ctx context.Context, k *IdempotencyKey) (bool, error) {
+	return InsertIdempotencyKey(ctx, s.db, k)
+}
+
+func (s *SQLStore) SelectIdempotencyKey(ctx context.Context, userID int64, key string) (IdempotencyKey, error) {
+	return SelectIdempotencyKey(ctx, s.db, userID, key)
+}
+
+func (s *SQLStore) UpdateIdempotencyKey(ctx context.Context, userID int64, key string, exprID int64, statusCode int) error {
+	return UpdateIdempotencyKey(ctx, s.db, userID, key, exprID, statusCode)
+}
+
+func (s *SQLStore) ReclaimIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (bool, error) {
+	return ReclaimIdempotencyKey(ctx, s.db, k, staleBefore)
+}
+
+func (s *SQLStore) DeleteIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	return DeleteIdempotencyKey(ctx, s.db, userID, key)
+}
+
+func (s *SQLStore) DeleteExpiredIdempotencyKeys(ctx context.Context, userID int64, before time.Time) error {
+	return DeleteExpiredIdempotencyKeys(ctx, s.db, userID, before)
+}
+
+func (s *SQLStore) InsertQuota(ctx context.Context, q *Quota) error {
+	return InsertQuota(ctx, s.db, q)
+}
+
+func (s *SQLStore) SelectQuota(ctx context.Context, userID int64) (Quota, error) {
+	return SelectQuota(ctx, s.db, userID)
+}
+
+func (s *SQLStore) DeleteQuota(ctx context.Context, userID int64) error {
+	return DeleteQuota(ctx, s.db, userID)
+}
+
+func (s *SQLStore) InsertSchedule(ctx context.Context, sc *Schedule) (int64, error) {
+	return InsertSchedule(ctx, s.db, sc)
+}
+
+func (s *SQLStore) SelectSchedules(ctx context.Context, userID int64) ([]Schedule, error) {
+	return SelectSchedules(ctx, s.db, userID)
+}
+
+func (s *SQLStore) SelectSchedule(ctx context.Context, userID, id int64) (Schedule, error) {
+	return SelectSchedule(ctx, s.db, userID, id)
+}
+
+func (s *SQLStore) SelectDueSchedules(ctx context.Context, now time.Time) ([]Schedule, error) {
+	return SelectDueSchedules(ctx, s.db, now)
+}
+
+func (s *SQLStore) SelectNextScheduleRun(ctx context.Context) (*time.Time, error) {
+	return SelectNextScheduleRun(ctx, s.db)
+}
+
+func (s *SQLStore) UpdateSchedule(ctx context.Context, sc *Schedule) error {
+	return UpdateSchedule(ctx, s.db, sc)
+}
+
+func (s *SQLStore) ClaimScheduleRun(ctx context.Context, userID, id int64, runAt, next time.Time) (bool, error) {
+	return ClaimScheduleRun(ctx, s.db, userID, id, runAt, next)
+}
+
+func (s *SQLStore) DeleteSchedule(ctx context.Context, userID, id int64) (bool, error) {
+	return DeleteSchedule(ctx, s.db, userID, id)
+}
+
+func (s *SQLStore) DeleteScheduleRuns(ctx context.Context, userID, scheduleID int64, keep int) (int64, error) {
+	return DeleteScheduleRuns(ctx, s.db, userID, scheduleID, keep)
+}
+
+var _ Store = (*SQLStore)(nil)